@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"strings"
+)
+
+const networkImportPath = "github.com/wnate/Go-000/tree/main/Week09/network"
+
+type generator struct {
+	buf    bytes.Buffer
+	file   *File
+	source string
+}
+
+func generate(f *File, source string) ([]byte, error) {
+	g := &generator{file: f, source: source}
+	g.genHeader()
+	g.genProtoIds()
+	for _, msg := range f.Messages {
+		g.genMessage(msg)
+	}
+	g.genRegister()
+
+	src, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("format generated code: %v", err)
+	}
+	return src, nil
+}
+
+func (g *generator) p(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+	g.buf.WriteByte('\n')
+}
+
+func (g *generator) genHeader() {
+	g.p("// Code generated by pktgen. DO NOT EDIT.")
+	g.p("// source: %s", g.source)
+	g.p("")
+	g.p("package %s", g.file.Package)
+	g.p("")
+	g.p("import (")
+	g.p(`"fmt"`)
+	if g.useMath() {
+		g.p(`"math"`)
+	}
+	g.p("")
+	g.p(`"%s"`, networkImportPath)
+	g.p(")")
+	g.p("")
+}
+
+func (g *generator) useMath() bool {
+	for _, msg := range g.file.Messages {
+		for _, field := range msg.Fields {
+			if field.Type == "float32" || field.Type == "float64" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (g *generator) genProtoIds() {
+	g.p("// 协议ID")
+	g.p("const (")
+	for _, msg := range g.file.Messages {
+		if msg.HasId {
+			g.p("ProtoId%s uint32 = %d", msg.Name, msg.ProtoId)
+		}
+	}
+	g.p(")")
+	g.p("")
+}
+
+func (g *generator) genMessage(msg *Message) {
+	g.p("type %s struct {", msg.Name)
+	for _, field := range msg.Fields {
+		g.p("%s %s", fieldName(field), goType(field))
+	}
+	g.p("}")
+	g.p("")
+
+	if msg.HasId {
+		g.p("func (m *%s) ProtoId() uint32 {", msg.Name)
+		g.p("return ProtoId%s", msg.Name)
+		g.p("}")
+		g.p("")
+	}
+
+	g.p("func (m *%s) Encode(pkt *network.Packet) {", msg.Name)
+	for _, field := range msg.Fields {
+		g.genEncodeField(field)
+	}
+	g.p("}")
+	g.p("")
+
+	g.p("func (m *%s) Decode(pkt *network.Packet) (err error) {", msg.Name)
+	g.p("defer func() {")
+	g.p("// 包长度不够时Packet的ReadXxx会越界")
+	g.p("if r := recover(); r != nil {")
+	g.p(`err = fmt.Errorf("decode %s failed: %%v", r)`, msg.Name)
+	g.p("}")
+	g.p("}()")
+	g.p("return m.decode(pkt)")
+	g.p("}")
+	g.p("")
+
+	g.p("func (m *%s) decode(pkt *network.Packet) (err error) {", msg.Name)
+	for _, field := range msg.Fields {
+		if field.Repeated && !isBytes(field) {
+			g.p("var n int")
+			break
+		}
+	}
+	for _, field := range msg.Fields {
+		g.genDecodeField(field)
+	}
+	g.p("return nil")
+	g.p("}")
+	g.p("")
+}
+
+func (g *generator) genEncodeField(field *Field) {
+	v := "m." + fieldName(field)
+	if isBytes(field) {
+		g.p(encodeExpr("bytes", v))
+		return
+	}
+	if !field.Repeated {
+		g.p(encodeExpr(field.Type, v))
+		return
+	}
+	g.p("pkt.WriteUint32(uint32(len(%s)))", v)
+	g.p("for i := range %s {", v)
+	g.p(encodeExpr(field.Type, v+"[i]"))
+	g.p("}")
+}
+
+func (g *generator) genDecodeField(field *Field) {
+	v := "m." + fieldName(field)
+	if isBytes(field) {
+		g.p(decodeExpr("bytes", v))
+		return
+	}
+	if !field.Repeated {
+		g.p(decodeExpr(field.Type, v))
+		return
+	}
+	// 元素个数由对端决定，不合法时返回错误
+	g.p("if n, err = pkt.ReadCount(); err != nil {")
+	g.p("return err")
+	g.p("}")
+	g.p("%s = make(%s, n)", v, goType(field))
+	g.p("for i := range %s {", v)
+	g.p(decodeExpr(field.Type, v+"[i]"))
+	g.p("}")
+}
+
+func (g *generator) genRegister() {
+	g.p("// 注册所有协议消息")
+	g.p("func RegisterMessages(r *network.MessageRegistry) {")
+	for _, msg := range g.file.Messages {
+		if msg.HasId {
+			g.p("r.Register(ProtoId%s, (*%s)(nil))", msg.Name, msg.Name)
+		}
+	}
+	g.p("}")
+}
+
+// 整个字段按WriteStringBytes编码：bytes和[]uint8，和反射编码保持一致；
+// []bytes是bytes的数组，和其他数组一样先写个数再逐个编码
+func isBytes(field *Field) bool {
+	if field.Repeated {
+		return field.Type == "uint8" || field.Type == "byte"
+	}
+	return field.Type == "bytes"
+}
+
+func goType(field *Field) string {
+	t := field.Type
+	switch t {
+	case "bytes":
+		t = "[]byte"
+	case "byte":
+		t = "uint8"
+	}
+	if field.Repeated {
+		return "[]" + t
+	}
+	return t
+}
+
+func encodeExpr(typ, v string) string {
+	switch typ {
+	case "bool":
+		return fmt.Sprintf("pkt.WriteBool(%s)", v)
+	case "int8":
+		return fmt.Sprintf("pkt.WriteByte(byte(%s))", v)
+	case "uint8", "byte":
+		return fmt.Sprintf("pkt.WriteByte(%s)", v)
+	case "int16":
+		return fmt.Sprintf("pkt.WriteInt16(%s)", v)
+	case "uint16":
+		return fmt.Sprintf("pkt.WriteInt16(int16(%s))", v)
+	case "int32":
+		return fmt.Sprintf("pkt.WriteInt32(%s)", v)
+	case "uint32":
+		return fmt.Sprintf("pkt.WriteUint32(%s)", v)
+	case "int64":
+		return fmt.Sprintf("pkt.WriteInt64(%s)", v)
+	case "uint64":
+		return fmt.Sprintf("pkt.WriteInt64(int64(%s))", v)
+	case "float32":
+		return fmt.Sprintf("pkt.WriteUint32(math.Float32bits(%s))", v)
+	case "float64":
+		return fmt.Sprintf("pkt.WriteInt64(int64(math.Float64bits(%s)))", v)
+	case "string":
+		return fmt.Sprintf("pkt.WriteString(%s)", v)
+	case "bytes":
+		return fmt.Sprintf("pkt.WriteStringBytes(%s)", v)
+	}
+	return fmt.Sprintf("%s.Encode(pkt)", v)
+}
+
+func decodeExpr(typ, v string) string {
+	switch typ {
+	case "bool":
+		return fmt.Sprintf("%s = pkt.ReadBool()", v)
+	case "int8":
+		return fmt.Sprintf("%s = int8(pkt.ReadByte())", v)
+	case "uint8", "byte":
+		return fmt.Sprintf("%s = pkt.ReadByte()", v)
+	case "int16":
+		return fmt.Sprintf("%s = pkt.ReadInt16()", v)
+	case "uint16":
+		return fmt.Sprintf("%s = uint16(pkt.ReadInt16())", v)
+	case "int32":
+		return fmt.Sprintf("%s = pkt.ReadInt32()", v)
+	case "uint32":
+		return fmt.Sprintf("%s = pkt.ReadUint32()", v)
+	case "int64":
+		return fmt.Sprintf("%s = pkt.ReadInt64()", v)
+	case "uint64":
+		return fmt.Sprintf("%s = uint64(pkt.ReadInt64())", v)
+	case "float32":
+		return fmt.Sprintf("%s = math.Float32frombits(pkt.ReadUint32())", v)
+	case "float64":
+		return fmt.Sprintf("%s = math.Float64frombits(uint64(pkt.ReadInt64()))", v)
+	case "string":
+		return fmt.Sprintf("%s = pkt.ReadString()", v)
+	case "bytes":
+		return fmt.Sprintf("%s = []byte(pkt.ReadString())", v)
+	}
+	return fmt.Sprintf("if err = %s.decode(pkt); err != nil {\nreturn err\n}", v)
+}
+
+// user_id -> UserId
+func fieldName(field *Field) string {
+	parts := strings.Split(field.Name, "_")
+	for i, part := range parts {
+		if part != "" {
+			parts[i] = strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// 生成的代码放在一个临时的main包里编译运行：每个字段填上非零值，
+// 用生成的Encode/Decode来回一遍，再和反射编码的结果逐字节比较
+const roundTripMain = `package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+
+	"github.com/wnate/Go-000/tree/main/Week09/network"
+)
+
+// 底层类型相同但没有Encode/Decode方法，BinaryMessageCodec会走反射
+type reflectPlain Plain
+type reflectRepeated Repeated
+
+func fill(v reflect.Value, seed int) {
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(int64(-seed - 1))
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(uint64(seed + 200))
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(float64(seed) + 0.5)
+	case reflect.String:
+		v.SetString(fmt.Sprint("s", seed))
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 3, 3))
+		for i := 0; i < 3; i++ {
+			fill(v.Index(i), seed+i)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			fill(v.Field(i), seed+i)
+		}
+	default:
+		panic("unexpected kind " + v.Kind().String())
+	}
+}
+
+func readAll(pkt *network.Packet) []byte {
+	var b []byte
+	for pkt.Readable() {
+		b = append(b, pkt.ReadByte())
+	}
+	return b
+}
+
+func encode(msg interface{}) []byte {
+	pkt := network.NewPacket()
+	defer pkt.Release()
+	if err := network.BinaryMessageCodec.Marshal(pkt, msg); err != nil {
+		panic(err)
+	}
+	return readAll(pkt)
+}
+
+func check(name string, msg, decoded, reflectMsg interface{}) error {
+	fill(reflect.ValueOf(msg).Elem(), 1)
+
+	pkt := network.NewPacket()
+	defer pkt.Release()
+	msg.(network.PacketMarshaler).Encode(pkt)
+	if err := decoded.(network.PacketMarshaler).Decode(pkt); err != nil {
+		return fmt.Errorf("%s decode: %v", name, err)
+	}
+	if pkt.Readable() {
+		return fmt.Errorf("%s: %d bytes left after decode", name, pkt.ReadableBytes())
+	}
+	if !reflect.DeepEqual(msg, decoded) {
+		return fmt.Errorf("%s round trip:\n%+v\n%+v", name, msg, decoded)
+	}
+
+	reflect.ValueOf(reflectMsg).Elem().Set(reflect.ValueOf(msg).Elem().Convert(reflect.TypeOf(reflectMsg).Elem()))
+	if !bytes.Equal(encode(msg), encode(reflectMsg)) {
+		return fmt.Errorf("%s: generated encoding differs from reflection", name)
+	}
+	return nil
+}
+
+func main() {
+	for _, err := range []error{
+		check("Plain", &Plain{}, &Plain{}, &reflectPlain{}),
+		check("Repeated", &Repeated{}, &Repeated{}, &reflectRepeated{}),
+	} {
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	fmt.Println("ok")
+}
+`
+
+// 所有基础类型各一个字段，Plain里是单个值，Repeated里是数组
+func allScalarsPkt() string {
+	var types []string
+	for typ := range scalarTypes {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	var b strings.Builder
+	b.WriteString("package main\n\n")
+	b.WriteString("message Item {\n    int32 id\n    string name\n}\n\n")
+	b.WriteString("message Plain = 1 {\n")
+	for _, typ := range types {
+		fmt.Fprintf(&b, "    %s v_%s\n", typ, typ)
+	}
+	b.WriteString("    Item item\n}\n\n")
+	b.WriteString("message Repeated = 2 {\n")
+	for _, typ := range types {
+		fmt.Fprintf(&b, "    []%s v_%s\n", typ, typ)
+	}
+	b.WriteString("    []Item items\n}\n")
+	return b.String()
+}
+
+func TestGenerateAllScalarsRoundTrip(t *testing.T) {
+	if testing.Short() {
+		t.Skip("compiles generated code with the go command")
+	}
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+
+	f, err := parse(strings.NewReader(allScalarsPkt()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := generate(f, "all.pkt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 放在模块里面，生成的代码才能import network
+	dir, err := ioutil.TempDir(".", "roundtrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "all.pkt.go"), src, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte(roundTripMain), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(goCmd, "run", ".")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil || strings.TrimSpace(string(out)) != "ok" {
+		t.Fatalf("run generated code: %v\n%s\n%s", err, out, src)
+	}
+}
@@ -0,0 +1,49 @@
+// pktgen 根据消息描述文件生成带Encode/Decode方法的Go结构体和协议ID常量，
+// 保证客户端和服务端的消息布局一致
+//
+//	go run ./cmd/pktgen -in protocol/demo.pkt -out protocol/demo.pkt.go
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	in := flag.String("in", "", "message definition file")
+	out := flag.String("out", "", "output go file, default is <in>.go")
+	flag.Parse()
+
+	if *in == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *out == "" {
+		*out = *in + ".go"
+	}
+
+	if err := run(*in, *out); err != nil {
+		log.Fatalf("pktgen: %v", err)
+	}
+}
+
+func run(in, out string) error {
+	fd, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	f, err := parse(fd)
+	if err != nil {
+		return err
+	}
+	src, err := generate(f, filepath.Base(in))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(out, src, 0644)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// 描述文件格式：
+//
+//	package protocol
+//
+//	// 注释
+//	message Item {
+//	    int32 id
+//	    string name
+//	}
+//
+//	message LoginReq = 1001 {
+//	    int64 uid
+//	    []Item items
+//	}
+//
+// 带 "= 协议ID" 的是协议消息，会生成协议ID常量，不带的只能作为其他消息的字段
+type File struct {
+	Package  string
+	Messages []*Message
+}
+
+type Message struct {
+	Name    string
+	ProtoId uint32
+	HasId   bool
+	Fields  []*Field
+	Line    int
+}
+
+type Field struct {
+	Name     string
+	Type     string // 基础类型或消息名
+	Repeated bool
+	Line     int
+}
+
+var scalarTypes = map[string]bool{
+	"bool":    true,
+	"int8":    true,
+	"uint8":   true,
+	"byte":    true,
+	"int16":   true,
+	"uint16":  true,
+	"int32":   true,
+	"uint32":  true,
+	"int64":   true,
+	"uint64":  true,
+	"float32": true,
+	"float64": true,
+	"string":  true,
+	"bytes":   true,
+}
+
+func parse(r io.Reader) (*File, error) {
+	f := &File{}
+	var (
+		cur    *Message
+		lineNo int
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		tokens := strings.Fields(line)
+		if len(tokens) == 0 {
+			continue
+		}
+
+		if cur != nil {
+			if tokens[0] == "}" {
+				f.Messages = append(f.Messages, cur)
+				cur = nil
+				continue
+			}
+			if len(tokens) != 2 {
+				return nil, fmt.Errorf("line %d: field must be `type name`", lineNo)
+			}
+			field := &Field{Name: tokens[1], Type: tokens[0], Line: lineNo}
+			if strings.HasPrefix(field.Type, "[]") {
+				field.Repeated = true
+				field.Type = field.Type[2:]
+			}
+			if !isIdent(field.Name) || !isIdent(field.Type) {
+				return nil, fmt.Errorf("line %d: illegal field `%s`", lineNo, strings.Join(tokens, " "))
+			}
+			cur.Fields = append(cur.Fields, field)
+			continue
+		}
+
+		switch tokens[0] {
+		case "package":
+			if len(tokens) != 2 || !isIdent(tokens[1]) {
+				return nil, fmt.Errorf("line %d: illegal package declaration", lineNo)
+			}
+			f.Package = tokens[1]
+		case "message":
+			msg, err := parseMessageHeader(tokens, lineNo)
+			if err != nil {
+				return nil, err
+			}
+			cur = msg
+		default:
+			return nil, fmt.Errorf("line %d: unexpected `%s`", lineNo, tokens[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if cur != nil {
+		return nil, fmt.Errorf("line %d: message %s not closed", cur.Line, cur.Name)
+	}
+	if f.Package == "" {
+		return nil, fmt.Errorf("missing package declaration")
+	}
+	return f, f.check()
+}
+
+// message Name {  或  message Name = 1001 {
+func parseMessageHeader(tokens []string, lineNo int) (*Message, error) {
+	msg := &Message{Line: lineNo}
+	switch {
+	case len(tokens) == 3 && tokens[2] == "{":
+	case len(tokens) == 5 && tokens[2] == "=" && tokens[4] == "{":
+		id, err := strconv.ParseUint(tokens[3], 0, 32)
+		if err != nil || id >= 1<<28 {
+			return nil, fmt.Errorf("line %d: illegal proto id `%s`", lineNo, tokens[3])
+		}
+		msg.ProtoId = uint32(id)
+		msg.HasId = true
+	default:
+		return nil, fmt.Errorf("line %d: message must be `message Name [= id] {`", lineNo)
+	}
+	msg.Name = tokens[1]
+	if !isIdent(msg.Name) {
+		return nil, fmt.Errorf("line %d: illegal message name `%s`", lineNo, msg.Name)
+	}
+	return msg, nil
+}
+
+// 检查重名、重复的协议ID和未定义的字段类型
+func (f *File) check() error {
+	names := make(map[string]bool)
+	ids := make(map[uint32]string)
+	for _, msg := range f.Messages {
+		if names[msg.Name] || scalarTypes[msg.Name] {
+			return fmt.Errorf("line %d: duplicate message %s", msg.Line, msg.Name)
+		}
+		names[msg.Name] = true
+		if !msg.HasId {
+			continue
+		}
+		if other, exist := ids[msg.ProtoId]; exist {
+			return fmt.Errorf("line %d: proto id %d already used by %s", msg.Line, msg.ProtoId, other)
+		}
+		ids[msg.ProtoId] = msg.Name
+	}
+	for _, msg := range f.Messages {
+		fieldNames := make(map[string]bool)
+		for _, field := range msg.Fields {
+			if fieldNames[field.Name] {
+				return fmt.Errorf("line %d: duplicate field %s", field.Line, field.Name)
+			}
+			fieldNames[field.Name] = true
+			if !scalarTypes[field.Type] && !names[field.Type] {
+				return fmt.Errorf("line %d: unknown type %s", field.Line, field.Type)
+			}
+			if field.Type == msg.Name && !field.Repeated {
+				return fmt.Errorf("line %d: message %s can not contain itself", field.Line, msg.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func isIdent(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
@@ -1,6 +1,6 @@
 module github.com/wnate/Go-000/tree/main/Week09
 
-go 1.15
+go 1.20
 
 require (
 	github.com/orcaman/concurrent-map v0.0.0-20210106121528-16402b402231
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
 	"github.com/wnate/Go-000/tree/main/Week09/network"
+	"github.com/wnate/Go-000/tree/main/Week09/protocol"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -10,25 +16,60 @@ func main() {
 	if svr.Start() != nil {
 		log.Fatal("start server err")
 	}
+	// 浏览器客户端走WebSocket，和TCP客户端共用同一套handler
+	if svr.StartWebSocket(":9998", "/ws") != nil {
+		log.Fatal("start websocket server err")
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+	<-signalChan
 
-	select {}
+	// 给连接10秒时间处理完手上的消息
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if dropped, err := svr.Shutdown(ctx); err != nil {
+		log.Printf("shutdown timeout, %d sessions dropped\n", dropped)
+	}
 }
 
 func NewDemoServer(listenAddr string) *DemoServer {
 	s := &DemoServer{
-		network.NewTcpServer(listenAddr),
+		TCPServer: network.NewTcpServer(listenAddr),
+		router:    network.NewRouter(),
+		messages:  network.NewMessageRegistry(network.BinaryMessageCodec),
 	}
-	s.SetSessionEventHandler(s)
+	protocol.RegisterMessages(s.messages)
+
+	s.router.SetOpenHandler(s.OnOpen)
+	s.router.SetCloseHandler(s.OnClose)
+	s.router.SetUnknownHandler(s.onUnknownPacket)
+	s.messages.Route(s.router, s.onEcho)
+	s.SetSessionEventHandler(network.Chain(s.router,
+		network.Recovery(),
+		network.RateLimit(100, 200),
+	))
 	return s
 }
 
 type DemoServer struct {
 	*network.TCPServer
+	router   *network.Router
+	messages *network.MessageRegistry
+}
+
+func (s *DemoServer) onEcho(session *network.Session, req *protocol.EchoReq) {
+	resp := &protocol.EchoResp{
+		Text:       req.Text,
+		ServerTime: time.Now().Unix(),
+	}
+	if err := s.messages.Send(session, resp); err != nil {
+		log.Printf("session[%s] send echo err:%v\n", session.StrId(), err)
+	}
 }
 
-func (s *DemoServer) OnRecvPacket(session *network.Session, pkt *network.Packet) {
-	log.Panicln("receive msg")
-	// todo 根据具体的消息协议号做不同的handle
+func (s *DemoServer) onUnknownPacket(session *network.Session, protoId uint32, pkt *network.Packet) {
+	log.Printf("session[%s] receive unknown proto id:%d\n", session.StrId(), protoId)
 }
 
 func (s *DemoServer) OnOpen(session *network.Session) error {
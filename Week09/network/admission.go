@@ -0,0 +1,85 @@
+package network
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTooManyConns      = errors.New("network: too many connections")
+	ErrTooManyConnsPerIP = errors.New("network: too many connections from same ip")
+	ErrAcceptRateLimited = errors.New("network: accept rate limited")
+)
+
+// 连接准入钩子，返回错误时拒绝连接，此时还没有创建Session
+type AdmissionHook func(conn net.Conn) error
+
+func newAdmission(opts *TcpOptions) *admission {
+	a := &admission{
+		opts:  opts,
+		perIP: make(map[string]int),
+	}
+	if opts.AcceptRate > 0 {
+		burst := opts.AcceptBurst
+		if burst < 1 {
+			burst = 1
+		}
+		a.acceptBucket = newTokenBucket(opts.AcceptRate, burst)
+	}
+	return a
+}
+
+// 连接数和accept速率控制
+type admission struct {
+	opts         *TcpOptions
+	acceptBucket *tokenBucket
+	mu           sync.Mutex
+	total        int
+	perIP        map[string]int
+}
+
+// 检查是否允许新连接，允许时计数，连接断开后需要调用release
+func (a *admission) admit(conn net.Conn) (ip string, err error) {
+	if a.acceptBucket != nil && !a.acceptBucket.take(time.Now()) {
+		return "", ErrAcceptRateLimited
+	}
+
+	ip = remoteIP(conn.RemoteAddr())
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.opts.MaxConns > 0 && a.total >= a.opts.MaxConns {
+		return "", ErrTooManyConns
+	}
+	if a.opts.MaxConnsPerIP > 0 && a.perIP[ip] >= a.opts.MaxConnsPerIP {
+		return "", ErrTooManyConnsPerIP
+	}
+	a.total++
+	a.perIP[ip]++
+	return ip, nil
+}
+
+func (a *admission) release(ip string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.total--
+	if a.perIP[ip]--; a.perIP[ip] <= 0 {
+		delete(a.perIP, ip)
+	}
+}
+
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
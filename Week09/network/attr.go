@@ -0,0 +1,48 @@
+package network
+
+import (
+	"context"
+)
+
+// 连接级别的属性，可以在多个协程里同时读写
+func (s *Session) SetAttr(key string, value interface{}) {
+	s.attrs.Store(key, value)
+}
+
+func (s *Session) Attr(key string) (interface{}, bool) {
+	return s.attrs.Load(key)
+}
+
+func (s *Session) DeleteAttr(key string) {
+	s.attrs.Delete(key)
+}
+
+// 遍历所有属性，f返回false时停止
+func (s *Session) RangeAttrs(f func(key string, value interface{}) bool) {
+	s.attrs.Range(func(k, v interface{}) bool {
+		return f(k.(string), v)
+	})
+}
+
+// 跟连接生命周期一致的context，session关闭时cancel，handler里调用下游时传进去，
+// 连接断开后不用再等结果。第一次调用时才创建，空闲连接不占内存。
+// 处理函数都能拿到session，所以不再单独传ctx参数，否则Router、RPC和pktgen生成的代码都要改签名
+func (s *Session) Context() context.Context {
+	s.ctxMu.Lock()
+	defer s.ctxMu.Unlock()
+	if s.ctx == nil {
+		s.ctx, s.cancelCtx = context.WithCancel(context.Background())
+		if s.isClosed() {
+			s.cancelCtx()
+		}
+	}
+	return s.ctx
+}
+
+func (s *Session) cancelContext() {
+	s.ctxMu.Lock()
+	if s.cancelCtx != nil {
+		s.cancelCtx()
+	}
+	s.ctxMu.Unlock()
+}
@@ -0,0 +1,90 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newPipeSession(t *testing.T) *Session {
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+	})
+	return NewSession(serverConn, NewDefaultTcpOptions())
+}
+
+func TestSessionContextCancelledOnClose(t *testing.T) {
+	s := newPipeSession(t)
+	ctx := s.Context()
+	if ctx.Err() != nil {
+		t.Fatal("context cancelled before close")
+	}
+	if s.Context() != ctx {
+		t.Fatal("context created twice")
+	}
+	s.Close()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context not cancelled on close")
+	}
+}
+
+func TestSessionContextAfterClose(t *testing.T) {
+	s := newPipeSession(t)
+	s.Close()
+	// 关闭后才第一次取，拿到的也必须是已经cancel的
+	if s.Context().Err() == nil {
+		t.Fatal("context created after close not cancelled")
+	}
+}
+
+func TestSessionAttrsConcurrent(t *testing.T) {
+	s := newPipeSession(t)
+	defer s.Close()
+
+	const (
+		writers = 4
+		keys    = 100
+	)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keys; i++ {
+				key := fmt.Sprint(w, "-", i)
+				s.SetAttr(key, i)
+				if v, ok := s.Attr(key); !ok || v.(int) != i {
+					t.Errorf("attr %s = %v %v, want %d", key, v, ok, i)
+				}
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < keys; i++ {
+				s.RangeAttrs(func(key string, value interface{}) bool {
+					_ = value.(int)
+					return true
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	n := 0
+	s.RangeAttrs(func(key string, value interface{}) bool {
+		n++
+		return true
+	})
+	if n != writers*keys {
+		t.Fatalf("range got %d attrs, want %d", n, writers*keys)
+	}
+	s.DeleteAttr("0-0")
+	if _, ok := s.Attr("0-0"); ok {
+		t.Fatal("attr still present after delete")
+	}
+}
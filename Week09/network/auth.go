@@ -0,0 +1,113 @@
+package network
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// 认证钩子，session认证通过前收到的包都交给它而不是SessionEventHandler。
+// 返回非空的userId表示认证通过，principal是业务自己的用户信息，之后用Session.Principal取出；
+// userId为空且没有错误表示还需要更多的包，比如挑战应答；返回错误时关闭session
+type Authenticator func(session *Session, pkt *Packet) (userId string, principal interface{}, err error)
+
+// 可选实现，同一个用户重复登录时旧的session被踢下线前回调，
+// 在旧session自己的处理协程里调用，发送的包会在连接关闭前写完
+type SessionKickHandler interface {
+	OnKick(session *Session)
+}
+
+// 认证通过的用户ID，没有认证时为空
+func (s *Session) UserId() string {
+	s.authMu.RLock()
+	defer s.authMu.RUnlock()
+	return s.userId
+}
+
+// 认证时Authenticator返回的用户信息
+func (s *Session) Principal() interface{} {
+	s.authMu.RLock()
+	defer s.authMu.RUnlock()
+	return s.principal
+}
+
+func (s *Session) IsAuthenticated() bool {
+	return s.UserId() != ""
+}
+
+func (s *Session) setUser(userId string, principal interface{}) {
+	s.authMu.Lock()
+	s.userId = userId
+	s.principal = principal
+	s.authMu.Unlock()
+}
+
+// 踢下线，和服务器优雅关闭一样处理完已收到的包、写完发送队列后关闭，回调OnKick而不是OnShutdown
+func (s *Session) kick() {
+	atomic.StoreInt32(&s.kicked, 1)
+	s.Shutdown()
+}
+
+func (s *Session) isKicked() bool {
+	return atomic.LoadInt32(&s.kicked) == 1
+}
+
+// 认证前的包交给Authenticator，包由调用方回收
+func (s *TCPServer) authenticate(session *Session, pkt *Packet) {
+	userId, principal, err := s.opts.Authenticator(session, pkt)
+	if err != nil {
+		log.Printf("tcp server[%s] session[%s] authenticate failed: %v\n", s.addr, session.StrId(), err)
+		session.Close()
+		return
+	}
+	if userId == "" {
+		return
+	}
+	session.setUser(userId, principal)
+
+	// 同一个用户只保留最新的session
+	var old *Session
+	s.users.Upsert(userId, session, func(exist bool, valueInMap interface{}, newValue interface{}) interface{} {
+		if exist {
+			old = valueInMap.(*Session)
+		}
+		return newValue
+	})
+	if session.isClosed() {
+		// 绑定前刚好关闭了，OnClose里没能解除绑定
+		s.unbindUser(session)
+	}
+	if old != nil && old != session {
+		log.Printf("tcp server[%s] user %s login again, kick session[%s]\n", s.addr, userId, old.StrId())
+		old.kick()
+	}
+}
+
+// 用户下线时解除绑定，已经被新session顶掉的不动
+func (s *TCPServer) unbindUser(session *Session) {
+	userId := session.UserId()
+	if userId == "" {
+		return
+	}
+	s.users.RemoveCb(userId, func(key string, v interface{}, exists bool) bool {
+		return exists && v.(*Session) == session
+	})
+}
+
+// 按用户ID查找session，没有登录时返回nil
+func (s *TCPServer) GetSessionByUser(userId string) *Session {
+	obj, exist := s.users.Get(userId)
+	if !exist {
+		return nil
+	}
+	return obj.(*Session)
+}
+
+// 踢某个用户下线，返回用户是否在线
+func (s *TCPServer) KickUser(userId string) bool {
+	session := s.GetSessionByUser(userId)
+	if session == nil {
+		return false
+	}
+	session.kick()
+	return true
+}
@@ -0,0 +1,270 @@
+package network_test
+
+import (
+	"github.com/pkg/errors"
+	"github.com/wnate/Go-000/tree/main/Week09/network"
+	"github.com/wnate/Go-000/tree/main/Week09/testkit"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	protoLogin   uint32 = 1
+	protoWhoami  uint32 = 2
+	protoUser    uint32 = 3
+	protoKicked  uint32 = 4
+	protoHello   uint32 = 5
+	protoAnswer  uint32 = 6
+	protoProblem uint32 = 7
+)
+
+// 测试用的客户端，收到的包按协议ID放进各自的channel
+type authClient struct {
+	*network.TCPClient
+	users  chan string
+	kicked chan struct{}
+	closed chan struct{}
+}
+
+func dialAuthClient(t *testing.T, ln *testkit.Listener, r *network.Router) *authClient {
+	c := &authClient{
+		TCPClient: network.NewTcpClient("pipe", network.WithDialer(ln.Dial)),
+		users:     make(chan string, 1),
+		kicked:    make(chan struct{}, 1),
+		closed:    make(chan struct{}),
+	}
+	if r == nil {
+		r = network.NewRouter()
+	}
+	r.Register(protoUser, func(s *network.Session, pkt *network.Packet) {
+		c.users <- pkt.ReadString()
+	})
+	r.Register(protoKicked, func(s *network.Session, pkt *network.Packet) {
+		c.kicked <- struct{}{}
+	})
+	r.SetCloseHandler(func(s *network.Session) {
+		close(c.closed)
+	})
+	c.SetSessionEventHandler(r)
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Stop)
+	return c
+}
+
+func (c *authClient) send(protoId uint32, body string) {
+	pkt := network.NewProtoPacket(protoId)
+	pkt.WriteString(body)
+	c.SendPacket(pkt)
+}
+
+// 问服务器自己登录的是谁，没有回复时返回空
+func (c *authClient) whoami() string {
+	c.send(protoWhoami, "")
+	select {
+	case user := <-c.users:
+		return user
+	case <-time.After(100 * time.Millisecond):
+		return ""
+	}
+}
+
+func (c *authClient) waitClosed(t *testing.T) {
+	t.Helper()
+	select {
+	case <-c.closed:
+	case <-time.After(time.Second):
+		t.Fatal("client not closed")
+	}
+}
+
+// 登录包的消息体就是用户ID
+func loginByName(session *network.Session, pkt *network.Packet) (string, interface{}, error) {
+	if protoId := pkt.ReadUint32(); protoId != protoLogin {
+		return "", nil, errors.Errorf("expect login, got proto %d", protoId)
+	}
+	return pkt.ReadString(), nil, nil
+}
+
+func startAuthServer(t *testing.T, authenticator network.Authenticator) (*network.TCPServer, *testkit.Listener) {
+	r := network.NewRouter()
+	r.Register(protoWhoami, func(s *network.Session, pkt *network.Packet) {
+		resp := network.NewProtoPacket(protoUser)
+		resp.WriteString(s.UserId())
+		s.SendPacket(resp)
+	})
+	r.SetKickHandler(func(s *network.Session) {
+		s.SendPacket(network.NewProtoPacket(protoKicked))
+	})
+	ln := testkit.NewListener()
+	server := network.NewTcpServer("pipe", network.WithAuthenticator(authenticator))
+	server.SetSessionEventHandler(r)
+	if err := server.StartListener(ln); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Stop)
+	return server, ln
+}
+
+type account struct {
+	name  string
+	level int
+}
+
+func TestAuthChallenge(t *testing.T) {
+	// 第一步发hello，服务器回一个题目，第二步答对才算登录
+	var (
+		mu       sync.Mutex
+		problems = make(map[*network.Session]uint32)
+	)
+	challenge := func(s *network.Session, pkt *network.Packet) (string, interface{}, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch pkt.ReadUint32() {
+		case protoHello:
+			problems[s] = 41
+			resp := network.NewProtoPacket(protoProblem)
+			resp.WriteUint32(41)
+			s.SendPacket(resp)
+			return "", nil, nil
+		case protoAnswer:
+			problem, ok := problems[s]
+			if !ok || pkt.ReadUint32() != problem+1 {
+				return "", nil, errors.New("wrong answer")
+			}
+			return "carol", &account{name: "Carol", level: 3}, nil
+		}
+		return "", nil, errors.New("unexpected packet")
+	}
+	server, ln := startAuthServer(t, challenge)
+
+	c := dialAuthClient(t, ln, nil)
+
+	// 认证前的业务包交给Authenticator，不会到handler
+	if user := c.whoami(); user != "" {
+		t.Fatalf("whoami answered before login: %q", user)
+	}
+	c.waitClosed(t)
+
+	r := network.NewRouter()
+	r.Register(protoProblem, func(s *network.Session, pkt *network.Packet) {
+		answer := network.NewProtoPacket(protoAnswer)
+		answer.WriteUint32(pkt.ReadUint32() + 1)
+		s.SendPacket(answer)
+		// 答完题马上问，认证通过后的包才会交给handler
+		s.SendPacket(network.NewProtoPacket(protoWhoami))
+	})
+	c = dialAuthClient(t, ln, r)
+	c.send(protoHello, "")
+	select {
+	case user := <-c.users:
+		if user != "carol" {
+			t.Fatalf("whoami = %q, want carol", user)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("challenge login timeout")
+	}
+	session := server.GetSessionByUser("carol")
+	if session == nil {
+		t.Fatal("carol not bound")
+	}
+	if acc, ok := session.Principal().(*account); !ok || acc.level != 3 {
+		t.Fatalf("principal = %#v", session.Principal())
+	}
+}
+
+func TestAuthFailureClosesSession(t *testing.T) {
+	server, ln := startAuthServer(t, loginByName)
+	c := dialAuthClient(t, ln, nil)
+
+	c.send(protoWhoami, "")
+	c.waitClosed(t)
+	if server.GetSessionByUser("") != nil {
+		t.Fatal("failed session bound to empty user")
+	}
+}
+
+func TestDuplicateLoginKicksOld(t *testing.T) {
+	server, ln := startAuthServer(t, loginByName)
+
+	first := dialAuthClient(t, ln, nil)
+	first.send(protoLogin, "alice")
+	if user := first.whoami(); user != "alice" {
+		t.Fatalf("first login as %q", user)
+	}
+	firstSession := server.GetSessionByUser("alice")
+
+	second := dialAuthClient(t, ln, nil)
+	second.send(protoLogin, "alice")
+	if user := second.whoami(); user != "alice" {
+		t.Fatalf("second login as %q", user)
+	}
+
+	// 旧连接先收到OnKick里发的包，然后被关闭
+	select {
+	case <-first.kicked:
+	case <-time.After(time.Second):
+		t.Fatal("old session not notified by OnKick")
+	}
+	first.waitClosed(t)
+
+	// 旧session关闭不会把新的绑定解除
+	session := server.GetSessionByUser("alice")
+	if session == nil || session == firstSession {
+		t.Fatal("alice should be bound to the new session")
+	}
+	if user := second.whoami(); user != "alice" {
+		t.Fatal("new session affected by kicking the old one")
+	}
+}
+
+func TestUserUnboundOnClose(t *testing.T) {
+	server, ln := startAuthServer(t, loginByName)
+
+	c := dialAuthClient(t, ln, nil)
+	c.send(protoLogin, "dave")
+	if user := c.whoami(); user != "dave" {
+		t.Fatalf("login as %q", user)
+	}
+	session := server.GetSessionByUser("dave")
+	c.Stop()
+
+	select {
+	case <-session.Done():
+	case <-time.After(time.Second):
+		t.Fatal("server session not closed")
+	}
+	// OnClose在Done之后才调用完，等一会儿
+	deadline := time.Now().Add(time.Second)
+	for server.GetSessionByUser("dave") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("dave still bound after disconnect")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestKickUser(t *testing.T) {
+	server, ln := startAuthServer(t, loginByName)
+
+	if server.KickUser("nobody") {
+		t.Fatal("kick a user that is not online")
+	}
+
+	c := dialAuthClient(t, ln, nil)
+	c.send(protoLogin, "erin")
+	if user := c.whoami(); user != "erin" {
+		t.Fatalf("login as %q", user)
+	}
+	if !server.KickUser("erin") {
+		t.Fatal("kick online user returned false")
+	}
+	select {
+	case <-c.kicked:
+	case <-time.After(time.Second):
+		t.Fatal("kicked session not notified by OnKick")
+	}
+	c.waitClosed(t)
+}
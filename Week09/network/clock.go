@@ -0,0 +1,52 @@
+package network
+
+import "time"
+
+// 时间来源，session的定时检查和心跳都用它，测试时可以换成手动推进的假时钟
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	// d之后在单独的协程里调用f
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type Timer interface {
+	Stop() bool
+}
+
+// 系统时钟
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+func (opts *TcpOptions) clock() Clock {
+	if opts.Clock == nil {
+		return SystemClock
+	}
+	return opts.Clock
+}
@@ -0,0 +1,261 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+)
+
+// 默认最大包长
+const DefaultMaxFrameSize = 9999
+
+var ErrFrameTooLarge = errors.New("network: frame too large")
+
+// 消息帧编解码，负责在字节流里切分出一个个Packet
+type Codec interface {
+	// 把pkt的可读数据编码成一帧写入w，不回收pkt
+	Encode(w io.Writer, pkt *Packet) error
+	// 从r读出一帧
+	Decode(r *bufio.Reader) (*Packet, error)
+}
+
+// 可选实现，TcpOptions.MaxFrameSize通过它修改最大包长，和设置编解码的先后顺序无关
+type FrameSizeLimiter interface {
+	MaxFrameSize() uint32
+	// 返回最大包长为maxFrameSize的新编解码，不修改自身
+	WithMaxFrameSize(maxFrameSize uint32) Codec
+}
+
+// 默认编解码，4字节大端长度头，包长1~9999
+func NewDefaultCodec() Codec {
+	return NewLengthFieldCodec(4, DefaultMaxFrameSize)
+}
+
+// 定长长度头，headerSize只支持2或4字节，大端
+func NewLengthFieldCodec(headerSize int, maxFrameSize uint32) *LengthFieldCodec {
+	if headerSize != 2 && headerSize != 4 {
+		panic(fmt.Sprintf("unsupported length header size:%d", headerSize))
+	}
+	if headerSize == 2 && maxFrameSize > 0xFFFF {
+		maxFrameSize = 0xFFFF
+	}
+	return &LengthFieldCodec{
+		headerSize:   headerSize,
+		maxFrameSize: maxFrameSize,
+	}
+}
+
+// 长度头 | 消息体，长度不含自身
+type LengthFieldCodec struct {
+	headerSize   int
+	maxFrameSize uint32
+}
+
+func (c *LengthFieldCodec) MaxFrameSize() uint32 {
+	return c.maxFrameSize
+}
+
+func (c *LengthFieldCodec) WithMaxFrameSize(maxFrameSize uint32) Codec {
+	return NewLengthFieldCodec(c.headerSize, maxFrameSize)
+}
+
+func (c *LengthFieldCodec) Encode(w io.Writer, pkt *Packet) error {
+	data := pkt.readableData()
+	pktLen := uint32(len(data))
+	if pktLen > c.maxFrameSize {
+		return errors.Wrapf(ErrFrameTooLarge, "encode packet len:%d", pktLen)
+	}
+	var header [4]byte
+	if c.headerSize == 2 {
+		packetEndian.PutUint16(header[:], uint16(pktLen))
+	} else {
+		packetEndian.PutUint32(header[:], pktLen)
+	}
+	if err := writeAll(w, header[:c.headerSize]); err != nil {
+		return err
+	}
+	return writeAll(w, data)
+}
+
+func (c *LengthFieldCodec) Decode(r *bufio.Reader) (*Packet, error) {
+	// 长度头直接在bufio的缓冲区里解析
+	header, err := r.Peek(c.headerSize)
+	if err != nil {
+		if err == io.EOF && len(header) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	var pktLen uint32
+	if c.headerSize == 2 {
+		pktLen = uint32(packetEndian.Uint16(header))
+	} else {
+		pktLen = packetEndian.Uint32(header)
+	}
+	r.Discard(c.headerSize)
+	if pktLen < 1 || pktLen > c.maxFrameSize {
+		return nil, errors.Errorf("receive illegal packet len:%d", pktLen)
+	}
+	return readPacketBody(r, pktLen)
+}
+
+// 变长长度头，和encoding/binary的Uvarint一致
+func NewVarintCodec(maxFrameSize uint32) *VarintCodec {
+	return &VarintCodec{
+		maxFrameSize: maxFrameSize,
+	}
+}
+
+type VarintCodec struct {
+	maxFrameSize uint32
+}
+
+func (c *VarintCodec) MaxFrameSize() uint32 {
+	return c.maxFrameSize
+}
+
+func (c *VarintCodec) WithMaxFrameSize(maxFrameSize uint32) Codec {
+	return NewVarintCodec(maxFrameSize)
+}
+
+func (c *VarintCodec) Encode(w io.Writer, pkt *Packet) error {
+	data := pkt.readableData()
+	if uint32(len(data)) > c.maxFrameSize {
+		return errors.Wrapf(ErrFrameTooLarge, "encode packet len:%d", len(data))
+	}
+	var header [binary.MaxVarintLen32]byte
+	n := binary.PutUvarint(header[:], uint64(len(data)))
+	if err := writeAll(w, header[:n]); err != nil {
+		return err
+	}
+	return writeAll(w, data)
+}
+
+func (c *VarintCodec) Decode(r *bufio.Reader) (*Packet, error) {
+	pktLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if pktLen < 1 || pktLen > uint64(c.maxFrameSize) {
+		return nil, errors.Errorf("receive illegal packet len:%d", pktLen)
+	}
+	return readPacketBody(r, uint32(pktLen))
+}
+
+// 转义字节，消息体里的分隔符和转义字节写成 转义字节 | 原字节^delimiterEscapeMask，
+// 所以二进制的包也能用，不含这两个字节的文本和不转义时完全一样
+const (
+	delimiterEscape     byte = 0x1B
+	delimiterEscapeMask byte = 0x80
+)
+
+// 分隔符切分，delimiter不能是转义字节0x1B或者0x9B
+func NewDelimiterCodec(delimiter byte, maxFrameSize uint32) *DelimiterCodec {
+	if delimiter == delimiterEscape || delimiter == delimiterEscape^delimiterEscapeMask {
+		panic(fmt.Sprintf("unsupported delimiter:%#x", delimiter))
+	}
+	return &DelimiterCodec{
+		delimiter:    delimiter,
+		maxFrameSize: maxFrameSize,
+	}
+}
+
+type DelimiterCodec struct {
+	delimiter    byte
+	maxFrameSize uint32
+}
+
+func (c *DelimiterCodec) MaxFrameSize() uint32 {
+	return c.maxFrameSize
+}
+
+func (c *DelimiterCodec) WithMaxFrameSize(maxFrameSize uint32) Codec {
+	return NewDelimiterCodec(c.delimiter, maxFrameSize)
+}
+
+func (c *DelimiterCodec) Encode(w io.Writer, pkt *Packet) error {
+	data := pkt.readableData()
+	if uint32(len(data)) > c.maxFrameSize {
+		return errors.Wrapf(ErrFrameTooLarge, "encode packet len:%d", len(data))
+	}
+	start := 0
+	for i, b := range data {
+		if b != c.delimiter && b != delimiterEscape {
+			continue
+		}
+		if err := writeAll(w, data[start:i]); err != nil {
+			return err
+		}
+		if err := writeAll(w, []byte{delimiterEscape, b ^ delimiterEscapeMask}); err != nil {
+			return err
+		}
+		start = i + 1
+	}
+	if err := writeAll(w, data[start:]); err != nil {
+		return err
+	}
+	return writeAll(w, []byte{c.delimiter})
+}
+
+func (c *DelimiterCodec) Decode(r *bufio.Reader) (*Packet, error) {
+	pkt := NewPacket()
+	escaped := false
+	for {
+		line, err := r.ReadSlice(c.delimiter)
+		if err == nil {
+			line = line[:len(line)-1]
+		} else if err != bufio.ErrBufferFull {
+			// 一帧超过了bufio的缓冲区时先存起来继续读，其他错误直接返回
+			pkt.Release()
+			return nil, err
+		}
+		escaped = unescapeTo(pkt, line, escaped)
+		if length := pkt.Length(); length > c.maxFrameSize {
+			pkt.Release()
+			return nil, errors.Wrapf(ErrFrameTooLarge, "decode packet len:%d", length)
+		}
+		if err == nil {
+			if escaped {
+				pkt.Release()
+				return nil, errors.New("frame ends with escape byte")
+			}
+			return pkt, nil
+		}
+	}
+}
+
+// 去掉转义写入pkt，escaped表示上一段以转义字节结尾，返回这一段是否以转义字节结尾
+func unescapeTo(pkt *Packet, data []byte, escaped bool) bool {
+	if escaped && len(data) > 0 {
+		pkt.WriteByte(data[0] ^ delimiterEscapeMask)
+		data = data[1:]
+		escaped = false
+	}
+	for {
+		i := bytes.IndexByte(data, delimiterEscape)
+		if i < 0 {
+			pkt.WriteBytes(data)
+			return escaped
+		}
+		pkt.WriteBytes(data[:i])
+		if i == len(data)-1 {
+			return true
+		}
+		pkt.WriteByte(data[i+1] ^ delimiterEscapeMask)
+		data = data[i+2:]
+	}
+}
+
+// 读取长度为pktLen的消息体，直接读进Packet的缓冲区
+func readPacketBody(r io.Reader, pktLen uint32) (*Packet, error) {
+	pkt := NewPacket()
+	if err := pkt.readFull(r, pktLen); err != nil {
+		// 回收packet
+		pkt.Release()
+		return nil, err
+	}
+	return pkt, nil
+}
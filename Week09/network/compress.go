@@ -0,0 +1,108 @@
+package network
+
+import (
+	"bytes"
+	"compress/flate"
+	"github.com/pkg/errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	flateWriterPool sync.Pool
+	flateReaderPool sync.Pool
+)
+
+// 让flate直接写进Packet的缓冲区
+type packetWriter struct {
+	pkt *Packet
+}
+
+func (w packetWriter) Write(b []byte) (int, error) {
+	w.pkt.WriteBytes(b)
+	return len(b), nil
+}
+
+// 协商开启压缩后，可读数据不少于threshold的包压缩后再发送，threshold<=0表示关闭
+func (c *PacketConn) setCompressThreshold(threshold int) {
+	atomic.StoreInt32(&c.compressThreshold, int32(threshold))
+}
+
+// 是否接受对端发来的压缩包，没有协商过压缩时收到压缩包按错误处理
+func (c *PacketConn) setRecvCompressed(enable bool) {
+	var v int32
+	if enable {
+		v = 1
+	}
+	atomic.StoreInt32(&c.recvCompressed, v)
+}
+
+// 解压后和没压缩的包一样不能超过编解码允许的最大包长，防止很小的包解压出巨大的数据
+func (c *PacketConn) maxFrameSize() uint32 {
+	if limiter, ok := c.codec.(FrameSizeLimiter); ok {
+		return limiter.MaxFrameSize()
+	}
+	return DefaultMaxFrameSize
+}
+
+// 压缩包：控制头(参数为压缩前的长度) | flate数据
+// 压缩后没有变小时原样发送，返回新包时原来的包已经回收
+func (c *PacketConn) compress(pkt *Packet) *Packet {
+	threshold := atomic.LoadInt32(&c.compressThreshold)
+	data := pkt.readableData()
+	if threshold <= 0 || len(data) < int(threshold) || uint32(len(data)) > c.maxFrameSize() {
+		return pkt
+	}
+	out := newControlPacket(pktKindCompressed, uint32(len(data)))
+	w, ok := flateWriterPool.Get().(*flate.Writer)
+	if ok {
+		w.Reset(packetWriter{out})
+	} else {
+		w, _ = flate.NewWriter(packetWriter{out}, flate.BestSpeed)
+	}
+	w.Write(data)
+	w.Close()
+	flateWriterPool.Put(w)
+
+	if out.Length() >= uint32(len(data)) {
+		out.Release()
+		return pkt
+	}
+	pkt.Release()
+	return out
+}
+
+// 还原压缩包，不是压缩包时原样返回，出错时pkt已经回收
+func (c *PacketConn) decompress(pkt *Packet) (*Packet, error) {
+	data := pkt.readableData()
+	if len(data) < 4 || packetEndian.Uint32(data)>>pktKindShift != pktKindCompressed {
+		return pkt, nil
+	}
+	defer pkt.Release()
+	if atomic.LoadInt32(&c.recvCompressed) == 0 {
+		return nil, errors.New("network: compressed packet without negotiation")
+	}
+	size := packetEndian.Uint32(data) & pktParamMask
+	if max := c.maxFrameSize(); size > max {
+		return nil, errors.Wrapf(ErrFrameTooLarge, "decompressed packet len:%d, max:%d", size, max)
+	}
+
+	// bytes.Reader实现了io.ByteReader，flate不会再套一层bufio
+	src := bytes.NewReader(data[4:])
+	r, ok := flateReaderPool.Get().(io.ReadCloser)
+	if ok {
+		r.(flate.Resetter).Reset(src, nil)
+	} else {
+		r = flate.NewReader(src)
+	}
+	defer flateReaderPool.Put(r)
+
+	// 声明的长度不可信，按实际解压出来的数据扩容
+	out := NewPacket()
+	if err := out.readFullGrow(r, size); err != nil {
+		out.Release()
+		return nil, errors.Wrap(err, "decompress packet")
+	}
+	return out, nil
+}
@@ -0,0 +1,191 @@
+package network
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"github.com/pkg/errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCompressThreshold(t *testing.T) {
+	c := &PacketConn{}
+	c.setCompressThreshold(64)
+
+	small := NewPacket()
+	small.WriteBytes(bytes.Repeat([]byte{'a'}, 63))
+	if c.compress(small) != small {
+		t.Fatal("packet below threshold should not be compressed")
+	}
+	small.Release()
+
+	// 随机数据压缩后不会变小，原样发送
+	noise := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(noise)
+	random := NewPacket()
+	random.WriteBytes(noise)
+	if c.compress(random) != random {
+		t.Fatal("incompressible packet should be sent as is")
+	}
+	random.Release()
+
+	c.setCompressThreshold(0)
+	big := NewPacket()
+	big.WriteBytes(bytes.Repeat([]byte{'a'}, 4096))
+	if c.compress(big) != big {
+		t.Fatal("packet compressed before negotiation")
+	}
+	big.Release()
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	c := &PacketConn{}
+	c.setCompressThreshold(64)
+	c.setRecvCompressed(true)
+
+	body := []byte(strings.Repeat("compress me ", 500))
+	pkt := NewPacket()
+	pkt.WriteBytes(body)
+	out := c.compress(pkt)
+	if rawPacketKind(out) != pktKindCompressed || out.Length() >= uint32(len(body)) {
+		t.Fatalf("compressed kind %d, %d bytes from %d", rawPacketKind(out), out.Length(), len(body))
+	}
+
+	restored, err := c.decompress(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Release()
+	if !bytes.Equal(restored.readableData(), body) {
+		t.Fatal("decompressed data differs")
+	}
+}
+
+// 压缩一段数据，控制头里的长度用size
+func compressedPacket(body []byte, size uint32) *Packet {
+	pkt := newControlPacket(pktKindCompressed, size)
+	w, _ := flate.NewWriter(packetWriter{pkt}, flate.BestSpeed)
+	w.Write(body)
+	w.Close()
+	return pkt
+}
+
+func TestDecompressWithoutNegotiation(t *testing.T) {
+	c := &PacketConn{}
+	body := bytes.Repeat([]byte{'a'}, 100)
+	if _, err := c.decompress(compressedPacket(body, 100)); err == nil {
+		t.Fatal("compressed packet accepted without negotiation")
+	}
+}
+
+func TestDecompressRejectsOversize(t *testing.T) {
+	c := &PacketConn{}
+	c.setRecvCompressed(true)
+
+	// 按声明的长度拒绝，不会真的解压出来
+	body := bytes.Repeat([]byte{'a'}, DefaultMaxFrameSize+1)
+	_, err := c.decompress(compressedPacket(body, DefaultMaxFrameSize+1))
+	if errors.Cause(err) != ErrFrameTooLarge {
+		t.Fatalf("oversize err = %v, want %v", err, ErrFrameTooLarge)
+	}
+
+	// 声明的长度比实际解压出来的长
+	_, err = c.decompress(compressedPacket(body[:100], 9000))
+	if errors.Cause(err) != io.ErrUnexpectedEOF {
+		t.Fatalf("short data err = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+// 用net.Pipe连起来的客户端和服务器session，服务器把收到的协议1的消息体用协议2原样发回
+func startCompressPair(t *testing.T, clientOpts, serverOpts *TcpOptions, handshake bool) (client, server *Session, recv chan string) {
+	connA, connB := net.Pipe()
+	client = NewSession(connA, clientOpts)
+	server = NewSession(connB, serverOpts)
+
+	recv = make(chan string, 1)
+	clientRouter := NewRouter()
+	clientRouter.Register(2, func(s *Session, pkt *Packet) {
+		recv <- pkt.ReadString()
+	})
+	client.SetEventHandler(clientRouter)
+	serverRouter := NewRouter()
+	serverRouter.Register(1, func(s *Session, pkt *Packet) {
+		resp := NewProtoPacket(2)
+		resp.WriteString(pkt.ReadString())
+		s.SendPacket(resp)
+	})
+	server.SetEventHandler(serverRouter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		client.Close()
+		server.Close()
+	})
+	go client.StartServe(ctx)
+	go server.StartServe(ctx)
+	if handshake {
+		client.startHandshake()
+	}
+	return client, server, recv
+}
+
+// 包按顺序处理，收到回显时双方都已经处理完握手
+func echo(t *testing.T, client *Session, recv chan string, body string) {
+	t.Helper()
+	req := NewProtoPacket(1)
+	req.WriteString(body)
+	client.SendPacket(req)
+	select {
+	case got := <-recv:
+		if got != body {
+			t.Fatalf("echo %d bytes, got %d bytes", len(body), len(got))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("echo timeout")
+	}
+}
+
+func compressThreshold(s *Session) int32 {
+	return atomic.LoadInt32(&s.conn.compressThreshold)
+}
+
+func TestHandshakeEnablesCompression(t *testing.T) {
+	opts := NewDefaultTcpOptions()
+	WithCompression(128)(opts)
+	client, server, recv := startCompressPair(t, opts, opts, true)
+
+	echo(t, client, recv, strings.Repeat("x", 4000))
+	if compressThreshold(client) != 128 || compressThreshold(server) != 128 {
+		t.Fatalf("threshold client %d server %d, want 128", compressThreshold(client), compressThreshold(server))
+	}
+}
+
+func TestHandshakeServerWithoutCompression(t *testing.T) {
+	clientOpts := NewDefaultTcpOptions()
+	WithCompression(128)(clientOpts)
+	client, server, recv := startCompressPair(t, clientOpts, NewDefaultTcpOptions(), true)
+
+	echo(t, client, recv, strings.Repeat("x", 4000))
+	if compressThreshold(client) != 0 || compressThreshold(server) != 0 {
+		t.Fatal("compression enabled although server does not support it")
+	}
+}
+
+func TestOldClientWithoutHandshake(t *testing.T) {
+	serverOpts := NewDefaultTcpOptions()
+	WithCompression(128)(serverOpts)
+	client, server, recv := startCompressPair(t, NewDefaultTcpOptions(), serverOpts, false)
+
+	// 老客户端不握手，服务器不能发压缩包给它
+	echo(t, client, recv, strings.Repeat("x", 4000))
+	if compressThreshold(server) != 0 {
+		t.Fatal("server compresses for a client that never shook hands")
+	}
+}
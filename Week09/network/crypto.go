@@ -0,0 +1,103 @@
+package network
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"github.com/pkg/errors"
+)
+
+var ErrUnencryptedPacket = errors.New("network: receive unencrypted packet after key exchange")
+
+// 加密包：控制头 | AES-GCM密文，控制头作为附加数据参与认证，心跳、握手、关闭等控制包不加密
+// nonce是每个方向各自递增的计数器，不在包里传输，TCP保证顺序，
+// 重放、丢弃或者调换顺序的包都会因为nonce对不上而解密失败
+type packetCipher struct {
+	aead    cipher.AEAD
+	nonce   [12]byte
+	counter uint64
+}
+
+func newPacketCipher(key []byte) (*packetCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &packetCipher{aead: aead}, nil
+}
+
+func (c *packetCipher) nextNonce() []byte {
+	packetEndian.PutUint64(c.nonce[4:], c.counter)
+	c.counter++
+	return c.nonce[:]
+}
+
+// 返回加密后的新包，原来的包已经回收
+func (c *packetCipher) encrypt(pkt *Packet) *Packet {
+	out := newControlPacket(pktKindEncrypted, 0)
+	b := out.buff.B
+	b = c.aead.Seal(b, c.nextNonce(), pkt.readableData(), b[:4])
+	out.buff.B = b
+	out.writeIndex = uint32(len(b))
+	pkt.Release()
+	return out
+}
+
+// 返回解密后的新包，pkt总是会被回收
+func (c *packetCipher) decrypt(pkt *Packet) (*Packet, error) {
+	defer pkt.Release()
+	data := pkt.readableData()
+	if len(data) < 4 || packetEndian.Uint32(data)>>pktKindShift != pktKindEncrypted {
+		return nil, ErrUnencryptedPacket
+	}
+	out := NewPacket()
+	b, err := c.aead.Open(out.buff.B[:0], c.nextNonce(), data[4:], data[:4])
+	if err != nil {
+		out.Release()
+		return nil, errors.Wrap(err, "decrypt packet")
+	}
+	out.buff.B = b
+	out.writeIndex = uint32(len(b))
+	return out, nil
+}
+
+// 用X25519交换出的共享密钥派生两个方向的AES-256密钥
+func deriveCiphers(priv *ecdh.PrivateKey, peerPub []byte, isClient bool) (send, recv *packetCipher, err error) {
+	pub, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientPub, serverPub := priv.PublicKey().Bytes(), peerPub
+	if !isClient {
+		clientPub, serverPub = serverPub, clientPub
+	}
+	derive := func(label string) []byte {
+		h := sha256.New()
+		h.Write([]byte(label))
+		h.Write(shared)
+		h.Write(clientPub)
+		h.Write(serverPub)
+		return h.Sum(nil)
+	}
+	c2s, err := newPacketCipher(derive("network c2s"))
+	if err != nil {
+		return nil, nil, err
+	}
+	s2c, err := newPacketCipher(derive("network s2c"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if isClient {
+		return c2s, s2c, nil
+	}
+	return s2c, c2s, nil
+}
@@ -0,0 +1,169 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+// 模拟一次密钥交换，返回客户端发送和服务器接收用的cipher
+func exchangeKeys(t *testing.T) (clientSend, serverRecv *packetCipher) {
+	clientPriv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPriv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSend, _, err = deriveCiphers(clientPriv, serverPriv.PublicKey().Bytes(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, serverRecv, err = deriveCiphers(serverPriv, clientPriv.PublicKey().Bytes(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clientSend, serverRecv
+}
+
+func plainPacket(body string) *Packet {
+	pkt := NewProtoPacket(1)
+	pkt.WriteString(body)
+	return pkt
+}
+
+func TestPacketCipherRoundTrip(t *testing.T) {
+	send, recv := exchangeKeys(t)
+
+	for _, body := range []string{"first secret", "", "third secret"} {
+		sealed := send.encrypt(plainPacket(body))
+		if bytes.Contains(sealed.readableData(), []byte("secret")) {
+			t.Fatal("plaintext visible in encrypted packet")
+		}
+		opened, err := recv.decrypt(sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id, got := opened.ReadUint32(), opened.ReadString(); id != 1 || got != body {
+			t.Errorf("decrypted %d %q, want 1 %q", id, got, body)
+		}
+		opened.Release()
+	}
+}
+
+func TestPacketCipherRejectsPlaintext(t *testing.T) {
+	_, recv := exchangeKeys(t)
+	if _, err := recv.decrypt(plainPacket("hello")); err != ErrUnencryptedPacket {
+		t.Fatalf("decrypt plaintext err = %v, want %v", err, ErrUnencryptedPacket)
+	}
+}
+
+func TestPacketCipherRejectsReplay(t *testing.T) {
+	send, recv := exchangeKeys(t)
+
+	sealed := send.encrypt(plainPacket("pay 100"))
+	replay := NewPacket()
+	replay.WriteBytes(sealed.readableData())
+
+	opened, err := recv.decrypt(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened.Release()
+	// 同样的密文再来一次，接收方的nonce已经往前走了
+	if _, err = recv.decrypt(replay); err == nil {
+		t.Fatal("replayed packet accepted")
+	}
+}
+
+func TestPacketCipherRejectsTamperedHeader(t *testing.T) {
+	send, recv := exchangeKeys(t)
+
+	sealed := send.encrypt(plainPacket("hello"))
+	// 控制头参与认证，改了参数也解不开
+	sealed.SetByte(3, sealed.GetByte(3)^1)
+	if _, err := recv.decrypt(sealed); err == nil {
+		t.Fatal("tampered header accepted")
+	}
+}
+
+func startEchoServer(t *testing.T, opt ...TcpOption) *TCPServer {
+	server := NewTcpServer("127.0.0.1:0", opt...)
+	r := NewRouter()
+	r.Register(1, func(s *Session, pkt *Packet) {
+		resp := NewProtoPacket(2)
+		resp.WriteString(pkt.ReadString())
+		s.SendPacket(resp)
+	})
+	server.SetSessionEventHandler(r)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Stop)
+	return server
+}
+
+func TestEncryptedClientServer(t *testing.T) {
+	server := startEchoServer(t, WithEncryption())
+
+	recv := make(chan string, 1)
+	r := NewRouter()
+	r.Register(2, func(s *Session, pkt *Packet) {
+		recv <- pkt.ReadString()
+	})
+	client := NewTcpClient(server.Addr().String(), WithEncryption(), WithCompression(64))
+	client.SetSessionEventHandler(r)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+
+	body := string(bytes.Repeat([]byte("encrypted "), 300))
+	client.SendPacket(plainPacket(body))
+	select {
+	case got := <-recv:
+		if got != body {
+			t.Fatal("echo differs")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("echo timeout")
+	}
+}
+
+func TestEncryptedClientPlainServer(t *testing.T) {
+	server := startEchoServer(t)
+
+	client := NewTcpClient(server.Addr().String(), WithEncryption())
+	client.SetSessionEventHandler(NewRouter())
+	if err := client.Start(); err == nil {
+		client.Stop()
+		t.Fatal("encrypted client connected to a server without encryption")
+	}
+}
+
+func TestPlainClientEncryptedServer(t *testing.T) {
+	server := startEchoServer(t, WithEncryption())
+
+	closed := make(chan struct{})
+	r := NewRouter()
+	r.SetCloseHandler(func(s *Session) {
+		close(closed)
+	})
+	client := NewTcpClient(server.Addr().String())
+	client.SetSessionEventHandler(r)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+
+	// 服务器等的是握手，收到普通包直接断开
+	client.SendPacket(plainPacket("hello"))
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("server kept a client that skipped key exchange")
+	}
+}
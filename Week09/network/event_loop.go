@@ -0,0 +1,134 @@
+package network
+
+import (
+	"github.com/pkg/errors"
+	"log"
+	"net"
+	"runtime"
+	"sync/atomic"
+)
+
+var ErrEventLoopUnsupported = errors.New("network: event loop not supported on this platform")
+
+// 事件循环模式：连接注册到epoll，可读时由事件循环线程读取并切分出包交给WorkerPool，
+// 没有常驻的读写协程，空闲连接只占用Session本身的内存
+func (s *TCPServer) startEventLoops() error {
+	if s.opts.EventLoops <= 0 {
+		return nil
+	}
+	if s.opts.WorkerPool == nil {
+		s.ownPool = NewWorkerPool(runtime.NumCPU(), 1024)
+		s.opts.WorkerPool = s.ownPool
+	}
+	for i := 0; i < s.opts.EventLoops; i++ {
+		loop, err := newEventLoop()
+		if err != nil {
+			s.stopEventLoops()
+			return err
+		}
+		s.loops = append(s.loops, loop)
+	}
+	return nil
+}
+
+func (s *TCPServer) stopEventLoops() {
+	for _, loop := range s.loops {
+		loop.close()
+	}
+	s.loops = nil
+}
+
+// 把连接交给事件循环，done在session关闭后调用
+func (s *TCPServer) serveConnInLoop(conn net.Conn, done func()) {
+	session := newSession(conn, s.opts, s.opts.frameCodec(s.opts.Codec))
+	session.SetEventHandler(s)
+	if s.opts.Encryption {
+		if err := session.serverKeyExchange(); err != nil {
+			log.Printf("tcp server[%s] key exchange with %s failed: %v\n", s.addr, conn.RemoteAddr(), err)
+			conn.Close()
+			done()
+			return
+		}
+	}
+	session.lazyWrite = true
+	session.touchRecvTime()
+
+	loop := s.loops[atomic.AddUint32(&s.nextLoop, 1)%uint32(len(s.loops))]
+	c, err := loop.attach(session, conn)
+	if err != nil {
+		log.Printf("tcp server[%s] add conn %s to event loop failed: %v\n", s.addr, conn.RemoteAddr(), err)
+		conn.Close()
+		done()
+		return
+	}
+	session.AddCloseHook(func(*Session) {
+		done()
+	})
+
+	s.sessions.Set(session.StrId(), session)
+
+	// OnOpen也在工作协程里执行，保证在所有收到的包之前
+	ok := session.submit(func() {
+		if err := s.OnOpen(session); err != nil {
+			session.Close()
+		}
+	})
+	if !ok {
+		session.Close()
+		return
+	}
+
+	if err = loop.register(c); err != nil {
+		log.Printf("tcp server[%s] add conn %s to event loop failed: %v\n", s.addr, conn.RemoteAddr(), err)
+		session.Close()
+		return
+	}
+	session.scheduleCron()
+
+	if s.isStopped() {
+		session.Shutdown()
+	}
+}
+
+// 有包要发时才启动写协程，写完队列就退出
+func (s *Session) startWrite() {
+	if atomic.CompareAndSwapInt32(&s.writing, 0, 1) {
+		go s.loopLazyWrite()
+	}
+}
+
+func (s *Session) loopLazyWrite() {
+	for {
+		ok := s.flushQueued()
+		atomic.StoreInt32(&s.writing, 0)
+		if !ok {
+			// 连接已经不能写了，等已经提交的包处理完再关闭
+			if !s.submit(s.Close) {
+				s.Close()
+			}
+			return
+		}
+		// 退出前刚好又有包进来，发送方看到writing还是1，不会再启动写协程
+		if len(s.outMsgCh) == 0 || !atomic.CompareAndSwapInt32(&s.writing, 0, 1) {
+			return
+		}
+	}
+}
+
+// 把发送队列里的包都写出去，返回false表示写失败
+func (s *Session) flushQueued() bool {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	defer s.conn.releaseWriter()
+	for !s.isClosed() {
+		select {
+		case pkt := <-s.outMsgCh:
+			if !s.writeBatch(pkt) {
+				return false
+			}
+		default:
+			return true
+		}
+	}
+	return true
+}
@@ -0,0 +1,242 @@
+//go:build linux
+// +build linux
+
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// 事件循环每次最多读取的字节数
+const eventLoopReadSize = 64 * 1024
+
+// 一个epoll实例和处理它的协程，水平触发，每次可读读一次，没读完下次还会通知
+type eventLoop struct {
+	epfd      int
+	wakeR     int // 关闭时写wakeW唤醒epoll_wait
+	wakeW     int
+	mu        sync.Mutex
+	conns     map[int]*loopConn
+	buf       []byte
+	src       bytes.Reader
+	reader    *bufio.Reader
+	closeOnce sync.Once
+}
+
+type loopConn struct {
+	session *Session
+	raw     syscall.RawConn
+	fd      int
+	pending []byte // 不完整的帧，等下次可读时拼上
+}
+
+func newEventLoop() (*eventLoop, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, errors.Wrap(err, "epoll create")
+	}
+	var p [2]int
+	if err = syscall.Pipe2(p[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(epfd)
+		return nil, errors.Wrap(err, "event loop pipe")
+	}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(p[0])}
+	if err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, p[0], &ev); err != nil {
+		syscall.Close(epfd)
+		syscall.Close(p[0])
+		syscall.Close(p[1])
+		return nil, errors.Wrap(err, "epoll add wake pipe")
+	}
+	l := &eventLoop{
+		epfd:  epfd,
+		wakeR: p[0],
+		wakeW: p[1],
+		conns: make(map[int]*loopConn),
+		buf:   make([]byte, eventLoopReadSize),
+	}
+	l.reader = bufio.NewReader(&l.src)
+	go l.run()
+	return l, nil
+}
+
+func (l *eventLoop) run() {
+	defer func() {
+		syscall.Close(l.epfd)
+		syscall.Close(l.wakeR)
+		syscall.Close(l.wakeW)
+	}()
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(l.epfd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			log.Printf("event loop epoll wait err: %v\n", err)
+			return
+		}
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == l.wakeR {
+				return
+			}
+			l.mu.Lock()
+			c := l.conns[fd]
+			l.mu.Unlock()
+			if c != nil {
+				l.handleReadable(c)
+			}
+		}
+	}
+}
+
+// 准备好连接，只支持能拿到fd的连接，TLS连接不行；需要再调用register才开始读
+func (l *eventLoop) attach(s *Session, conn net.Conn) (*loopConn, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.Errorf("event loop: unsupported conn type %T", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	c := &loopConn{
+		session: s,
+		raw:     raw,
+	}
+	if err = raw.Control(func(fd uintptr) { c.fd = int(fd) }); err != nil {
+		return nil, err
+	}
+
+	// fd关闭时内核会自动从epoll里删掉，这里只需要清理map
+	s.AddCloseHook(func(*Session) {
+		l.remove(c)
+	})
+	s.stopRead = func() {
+		l.detach(c)
+		s.finishWithPool(nil)
+	}
+	return c, nil
+}
+
+// 注册到epoll，开始读
+func (l *eventLoop) register(c *loopConn) error {
+	l.mu.Lock()
+	l.conns[c.fd] = c
+	l.mu.Unlock()
+
+	var ctlErr error
+	err := c.raw.Control(func(fd uintptr) {
+		ev := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP, Fd: int32(fd)}
+		ctlErr = syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_ADD, int(fd), &ev)
+	})
+	if err == nil {
+		err = ctlErr
+	}
+	if err != nil {
+		l.remove(c)
+		return errors.Wrap(err, "epoll add")
+	}
+	if c.session.isDraining() {
+		// 注册之前已经开始优雅关闭了，stopRead那时还没法停止读取
+		l.detach(c)
+	}
+	return nil
+}
+
+// fd可能已经被新连接复用，只删除自己
+func (l *eventLoop) remove(c *loopConn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[c.fd] != c {
+		return false
+	}
+	delete(l.conns, c.fd)
+	return true
+}
+
+// 停止读取，连接还没关闭
+func (l *eventLoop) detach(c *loopConn) {
+	if !l.remove(c) {
+		return
+	}
+	c.raw.Control(func(fd uintptr) {
+		syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, int(fd), nil)
+	})
+}
+
+func (l *eventLoop) handleReadable(c *loopConn) {
+	var (
+		n    int
+		rerr error
+	)
+	err := c.raw.Read(func(fd uintptr) bool {
+		n, rerr = syscall.Read(int(fd), l.buf)
+		return true
+	})
+	if err == nil {
+		err = rerr
+	}
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		return
+	}
+	if err == nil && n == 0 {
+		err = io.EOF
+	}
+	if err != nil {
+		l.detach(c)
+		c.session.finishWithPool(err)
+		return
+	}
+
+	data := l.buf[:n]
+	if len(c.pending) > 0 {
+		data = append(c.pending, data...)
+	}
+	consumed, err := l.decode(c.session, data)
+	if err != nil {
+		log.Printf("session[%s] decode err:%v\n", c.session.strId, err)
+		l.detach(c)
+		c.session.finishWithPool(err)
+		return
+	}
+	if rest := data[consumed:]; len(rest) > 0 {
+		c.pending = append(c.pending[:0], rest...)
+	} else {
+		c.pending = nil
+	}
+}
+
+// 从data里切分出完整的包交给工作协程，返回用掉的字节数，剩下的是不完整的帧
+func (l *eventLoop) decode(s *Session, data []byte) (int, error) {
+	l.src.Reset(data)
+	l.reader.Reset(&l.src)
+	consumed := 0
+	for consumed < len(data) {
+		pkt, err := s.conn.decode(l.reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return consumed, nil
+		}
+		if err != nil {
+			return consumed, err
+		}
+		consumed = len(data) - l.src.Len() - l.reader.Buffered()
+		if pkt = s.preparePacket(pkt); pkt != nil && !s.submitPacket(pkt) {
+			return consumed, ErrSessionClosed
+		}
+	}
+	return consumed, nil
+}
+
+func (l *eventLoop) close() {
+	l.closeOnce.Do(func() {
+		syscall.Write(l.wakeW, []byte{0})
+	})
+}
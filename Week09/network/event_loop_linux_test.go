@@ -0,0 +1,106 @@
+//go:build linux
+// +build linux
+
+package network
+
+import (
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// 空闲连接数，受文件描述符上限限制时会自动减少
+const benchIdleConns = 50000
+
+// 客户端和服务器各占一个fd
+func idleConnNum(b *testing.B) int {
+	n := benchIdleConns
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err == nil {
+		if max := int(rlimit.Cur-100) / 2; max < n {
+			b.Logf("RLIMIT_NOFILE=%d, idle conns %d -> %d", rlimit.Cur, n, max)
+			n = max
+		}
+	}
+	return n
+}
+
+func memInUse() uint64 {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapInuse + ms.StackInuse
+}
+
+// 建立n个空闲连接，统计每个连接的内存和协程数，然后测一个连接上的收发
+func benchmarkIdleConns(b *testing.B, opt ...TcpOption) {
+	router := NewRouter()
+	router.Register(1, func(s *Session, p *Packet) {
+		resp := NewProtoPacket(2)
+		resp.WriteBytes(p.readableData())
+		s.SendPacket(resp)
+	})
+	srv := NewTcpServer("127.0.0.1:0", opt...)
+	srv.SetSessionEventHandler(router)
+	if err := srv.Start(); err != nil {
+		b.Fatal(err)
+	}
+	defer srv.Stop()
+
+	n := idleConnNum(b)
+	baseMem := memInUse()
+	baseGoroutines := runtime.NumGoroutine()
+
+	conns := make([]net.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", srv.Addr().String())
+		if err != nil {
+			b.Fatalf("dial %d: %v", i, err)
+		}
+		conns = append(conns, conn)
+	}
+	for deadline := time.Now().Add(30 * time.Second); srv.SessionCount() < n; {
+		if time.Now().After(deadline) {
+			b.Fatalf("sessions %d/%d", srv.SessionCount(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 客户端的net.Conn也算在里面，两种模式是一样的
+	mem := memInUse()
+	goroutines := runtime.NumGoroutine()
+
+	pc := NewPacketConn(conns[0], nil)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pkt := NewProtoPacket(1)
+		pkt.WriteUint32(uint32(i))
+		if err := pc.SendPacket(pkt); err != nil {
+			b.Fatal(err)
+		}
+		resp, err := pc.ReadPacket()
+		if err != nil {
+			b.Fatal(err)
+		}
+		resp.Release()
+	}
+	b.StopTimer()
+	// ResetTimer会清掉自定义指标，放到最后
+	b.ReportMetric(float64(mem-baseMem)/float64(n), "B/conn")
+	b.ReportMetric(float64(goroutines-baseGoroutines)/float64(n), "goroutines/conn")
+}
+
+func BenchmarkIdleConnsGoroutine(b *testing.B) {
+	benchmarkIdleConns(b)
+}
+
+func BenchmarkIdleConnsEventLoop(b *testing.B) {
+	benchmarkIdleConns(b, WithEventLoop(runtime.NumCPU()))
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package network
+
+import "net"
+
+type eventLoop struct{}
+
+func newEventLoop() (*eventLoop, error) {
+	return nil, ErrEventLoopUnsupported
+}
+
+type loopConn struct{}
+
+func (l *eventLoop) attach(s *Session, conn net.Conn) (*loopConn, error) {
+	return nil, ErrEventLoopUnsupported
+}
+
+func (l *eventLoop) register(c *loopConn) error {
+	return ErrEventLoopUnsupported
+}
+
+func (l *eventLoop) close() {
+}
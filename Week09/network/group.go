@@ -0,0 +1,152 @@
+package network
+
+import (
+	"sync"
+)
+
+// 一组session，比如同一个房间里的玩家
+type group struct {
+	name     string
+	sessions map[uint32]*Session
+}
+
+func newGroupManager() *groupManager {
+	return &groupManager{
+		groups:  make(map[string]*group),
+		members: make(map[uint32]map[string]struct{}),
+	}
+}
+
+// 管理所有分组，session关闭时自动退出所有分组
+type groupManager struct {
+	mu      sync.RWMutex
+	groups  map[string]*group
+	members map[uint32]map[string]struct{} // session id -> 加入的分组
+}
+
+func (m *groupManager) join(name string, session *Session) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// 关闭时先关closeCh再在OnClose里leaveAll，在锁里检查就不会漏掉已经关闭的session
+	if session.isClosed() {
+		return false
+	}
+	g, ok := m.groups[name]
+	if !ok {
+		g = &group{
+			name:     name,
+			sessions: make(map[uint32]*Session),
+		}
+		m.groups[name] = g
+	}
+	g.sessions[session.Id()] = session
+
+	names, ok := m.members[session.Id()]
+	if !ok {
+		names = make(map[string]struct{})
+		m.members[session.Id()] = names
+	}
+	names[name] = struct{}{}
+	return true
+}
+
+func (m *groupManager) leave(name string, session *Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.leaveLocked(name, session.Id())
+	if names, ok := m.members[session.Id()]; ok {
+		delete(names, name)
+		if len(names) == 0 {
+			delete(m.members, session.Id())
+		}
+	}
+}
+
+func (m *groupManager) leaveAll(session *Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name := range m.members[session.Id()] {
+		m.leaveLocked(name, session.Id())
+	}
+	delete(m.members, session.Id())
+}
+
+// 空的分组直接删掉
+func (m *groupManager) leaveLocked(name string, sid uint32) {
+	g, ok := m.groups[name]
+	if !ok {
+		return
+	}
+	delete(g.sessions, sid)
+	if len(g.sessions) == 0 {
+		delete(m.groups, name)
+	}
+}
+
+// 分组里的session快照，分组不存在时返回nil
+func (m *groupManager) sessions(name string) []*Session {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	g, ok := m.groups[name]
+	if !ok {
+		return nil
+	}
+	sessions := make([]*Session, 0, len(g.sessions))
+	for _, session := range g.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+func (m *groupManager) groupNames(session *Session) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	names := make([]string, 0, len(m.members[session.Id()]))
+	for name := range m.members[session.Id()] {
+		names = append(names, name)
+	}
+	return names
+}
+
+// 同一个包发给多个session，每个接收者持有一个引用，不需要拷贝
+func broadcast(sessions []*Session, pkt *Packet) {
+	for _, session := range sessions {
+		pkt.Retain()
+		session.SendPacket(pkt)
+	}
+	pkt.Release()
+}
+
+// 加入分组，分组不存在时自动创建，session已经关闭时返回false
+func (s *TCPServer) JoinGroup(name string, session *Session) bool {
+	return s.groups.join(name, session)
+}
+
+// 退出分组，分组空了会自动删除
+func (s *TCPServer) LeaveGroup(name string, session *Session) {
+	s.groups.leave(name, session)
+}
+
+// 分组里的所有session
+func (s *TCPServer) GroupSessions(name string) []*Session {
+	return s.groups.sessions(name)
+}
+
+// session加入的所有分组
+func (s *TCPServer) SessionGroups(session *Session) []string {
+	return s.groups.groupNames(session)
+}
+
+// 发给所有连接，pkt由发送方回收
+func (s *TCPServer) Broadcast(pkt *Packet) {
+	sessions := make([]*Session, 0, s.sessions.Count())
+	for item := range s.sessions.IterBuffered() {
+		sessions = append(sessions, item.Val.(*Session))
+	}
+	broadcast(sessions, pkt)
+}
+
+// 发给分组里的所有连接，pkt由发送方回收
+func (s *TCPServer) BroadcastGroup(name string, pkt *Packet) {
+	broadcast(s.groups.sessions(name), pkt)
+}
@@ -7,3 +7,13 @@ type SessionEventHandler interface {
 
 	OnRecvPacket(session *Session, pkt *Packet)
 }
+
+// 可选实现，session读超时被关闭前回调
+type SessionIdleHandler interface {
+	OnIdle(session *Session)
+}
+
+// 可选实现，服务器优雅关闭时回调，可以在这里通知客户端，发送的包会在连接关闭前写完
+type SessionShutdownHandler interface {
+	OnShutdown(session *Session)
+}
@@ -0,0 +1,155 @@
+package network
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// 握手包：控制头(参数为功能位) | 数据
+// 客户端连上后先发握手，服务器回复双方都支持的功能，回复带handshakeAck；
+// 老客户端不发握手，服务器就一直按老的格式收发。
+// 开启加密时握手在session开始服务前同步完成，数据是X25519公钥，
+// 服务器写完回复后双方除控制包以外的包都经过AES-GCM加密，不认证对端身份，防中间人需要用TLS
+const (
+	featureCompress uint32 = 1 << 0 // flate压缩
+	featureEncrypt  uint32 = 1 << 1 // ECDH交换密钥后加密
+
+	handshakeAck uint32 = 1 << 27
+)
+
+// 本端支持的功能
+func (s *Session) localFeatures() uint32 {
+	var features uint32
+	if s.opts.CompressThreshold > 0 {
+		features |= featureCompress
+	}
+	if s.opts.Encryption {
+		features |= featureEncrypt
+	}
+	return features
+}
+
+// 客户端发起握手，没有需要协商的功能时不发，和老服务器保持兼容
+func (s *Session) startHandshake() error {
+	features := s.localFeatures()
+	if features&featureEncrypt != 0 {
+		return s.clientKeyExchange(features)
+	}
+	if features != 0 {
+		// 服务器回复后可能紧接着发压缩包，读协程处理到回复之前就要能接受
+		s.conn.setRecvCompressed(features&featureCompress != 0)
+		s.SendPacket(newControlPacket(pktKindHandshake, features))
+	}
+	return nil
+}
+
+// 不需要加密时在session里异步协商
+func (s *Session) handleHandshake(pkt *Packet) {
+	features := pkt.Seq() & s.localFeatures() &^ featureEncrypt
+	// 服务器先开启再回复，客户端收到回复后才会发压缩包
+	s.enableFeatures(features)
+	if pkt.Seq()&handshakeAck == 0 {
+		// 服务器回复协商结果
+		s.SendPacket(newControlPacket(pktKindHandshake, handshakeAck|features))
+	}
+}
+
+// 没有协商成功的功能同时关闭接收，比如客户端提出压缩但服务器不支持
+func (s *Session) enableFeatures(features uint32) {
+	if features&featureCompress != 0 {
+		s.conn.setCompressThreshold(s.opts.CompressThreshold)
+	}
+	s.conn.setRecvCompressed(features&featureCompress != 0)
+}
+
+// 客户端：发送公钥，等服务器回复公钥，session开始服务前调用
+func (s *Session) clientKeyExchange(features uint32) error {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	s.setHandshakeDeadline()
+	defer s.conn.conn.SetDeadline(time.Time{})
+
+	hello := newControlPacket(pktKindHandshake, features)
+	hello.WriteBytes(priv.PublicKey().Bytes())
+	if err = s.conn.SendPacket(hello); err != nil {
+		return err
+	}
+	reply, err := s.readHandshake()
+	if err != nil {
+		return err
+	}
+	defer reply.Release()
+	if reply.Seq()&handshakeAck == 0 || reply.Seq()&featureEncrypt == 0 {
+		return errors.New("network: server does not support encryption")
+	}
+	send, recv, err := deriveCiphers(priv, reply.readableData(), true)
+	if err != nil {
+		return err
+	}
+	s.conn.sendCipher, s.conn.recvCipher = send, recv
+	s.enableFeatures(reply.Seq() & features)
+	return nil
+}
+
+// 服务器：开启加密时第一个包必须是带公钥的握手，session开始服务前调用
+func (s *Session) serverKeyExchange() error {
+	s.setHandshakeDeadline()
+	defer s.conn.conn.SetDeadline(time.Time{})
+
+	hello, err := s.readHandshake()
+	if err != nil {
+		return err
+	}
+	defer hello.Release()
+	if hello.Seq()&handshakeAck != 0 || hello.Seq()&featureEncrypt == 0 {
+		return errors.New("network: client does not request encryption")
+	}
+	if s.conn.reader.Buffered() > 0 {
+		return errors.New("network: client sends packets before key exchange finished")
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	send, recv, err := deriveCiphers(priv, hello.readableData(), false)
+	if err != nil {
+		return err
+	}
+	features := hello.Seq() & s.localFeatures()
+	reply := newControlPacket(pktKindHandshake, handshakeAck|features)
+	reply.WriteBytes(priv.PublicKey().Bytes())
+	if err = s.conn.SendPacket(reply); err != nil {
+		return err
+	}
+	// 回复明文发出去之后再开启加密
+	s.conn.sendCipher, s.conn.recvCipher = send, recv
+	s.enableFeatures(features)
+	// 事件循环模式不用bufio读，缓冲区里已经没有数据了，读写缓冲区都先还回去
+	s.conn.reader = nil
+	s.conn.releaseWriter()
+	return nil
+}
+
+func (s *Session) setHandshakeDeadline() {
+	if s.opts.HandshakeTimeout > 0 {
+		s.conn.conn.SetDeadline(time.Now().Add(s.opts.HandshakeTimeout))
+	}
+}
+
+// 读一个握手包，已经解析过控制头
+func (s *Session) readHandshake() (*Packet, error) {
+	pkt, err := s.conn.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	pkt.parseHeader()
+	if pkt.kind != pktKindHandshake {
+		pkt.Release()
+		return nil, errors.Errorf("network: expect handshake packet, got kind %d", pkt.kind)
+	}
+	return pkt, nil
+}
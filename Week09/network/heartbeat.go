@@ -0,0 +1,92 @@
+package network
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+// 处理心跳包，返回true表示是控制包，已经处理并回收
+func (s *Session) handleControlPacket(pkt *Packet) bool {
+	switch pkt.kind {
+	case pktKindPing:
+		// ping带的数据原样带回去
+		pong := newControlPacket(pktKindPong, 0)
+		pong.WriteBytes(pkt.readableData())
+		s.SendPacket(pong)
+	case pktKindPong:
+	case pktKindHandshake:
+		s.handleHandshake(pkt)
+	case pktKindClose:
+		s.handlePeerClose(pkt)
+	default:
+		return false
+	}
+	pkt.Release()
+	return true
+}
+
+// 对端请求关闭：原样回一个关闭包，写完发送队列后关闭连接；
+// 自己已经在关闭时不再回应，避免两端来回发
+func (s *Session) handlePeerClose(pkt *Packet) {
+	if s.isDraining() {
+		return
+	}
+	reply := newControlPacket(pktKindClose, 0)
+	reply.WriteBytes(pkt.readableData())
+	s.SendPacket(reply)
+	atomic.StoreInt32(&s.peerClosed, 1)
+	s.Shutdown()
+}
+
+// 定时检查，返回false表示session需要关闭
+func (s *Session) onCron() bool {
+	now := s.opts.clock().Now()
+	if lastRecv := s.LastRecvPacketTime(); s.opts.ReadTimeout > 0 && now.Sub(lastRecv) > s.opts.ReadTimeout {
+		log.Printf("session[%s] idle timeout, last recv at %v\n", s.strId, lastRecv)
+		s.onIdle()
+		return false
+	}
+	if s.opts.HeartbeatInterval > 0 && now.Sub(s.lastPingTime) >= s.opts.HeartbeatInterval {
+		s.lastPingTime = now
+		s.SendPacket(NewPingPacket())
+	}
+	return true
+}
+
+// 创建心跳包
+func NewPingPacket() *Packet {
+	return newControlPacket(pktKindPing, 0)
+}
+
+// 是否是心跳包，不会移动读索引，用于还没经过Session解析的包
+func IsPingPacket(pkt *Packet) bool {
+	return rawPacketKind(pkt) == pktKindPing
+}
+
+// 是否是心跳回应包，不会移动读索引
+func IsPongPacket(pkt *Packet) bool {
+	return rawPacketKind(pkt) == pktKindPong
+}
+
+func rawPacketKind(pkt *Packet) uint32 {
+	if pkt.kind != pktKindNormal {
+		return pkt.kind
+	}
+	data := pkt.readableData()
+	if len(data) < 4 {
+		return pktKindNormal
+	}
+	return packetEndian.Uint32(data) >> pktKindShift
+}
+
+func (s *Session) onIdle() {
+	if h, ok := s.handler.(SessionIdleHandler); ok {
+		h.OnIdle(s)
+	}
+}
+
+func isTimeoutErr(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
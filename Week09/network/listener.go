@@ -0,0 +1,53 @@
+package network
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"os"
+	"strconv"
+)
+
+// systemd socket activation传进来的第一个fd
+const systemdListenFdsStart = 3
+
+// 监听地址，unix socket会先删掉上次没清理的socket文件
+func listen(network, addr string) (net.Listener, error) {
+	if network == "unix" {
+		if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+	}
+	return net.Listen(network, addr)
+}
+
+// systemd socket activation传入的所有listener，不是由systemd启动时返回空
+func ListenersFromSystemd() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, nil
+	}
+	// 避免子进程再继承
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, nfds)
+	for fd := systemdListenFdsStart; fd < systemdListenFdsStart+nfds; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		// FileListener会dup一份fd，原来的可以关掉
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, errors.Wrapf(err, "systemd listen fd %d", fd)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,357 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"log"
+	"math"
+	"reflect"
+	"sync"
+)
+
+// 消息序列化，把Go结构体写入Packet或者从Packet读出
+type MessageCodec interface {
+	Marshal(pkt *Packet, msg interface{}) error
+	Unmarshal(pkt *Packet, msg interface{}) error
+}
+
+var (
+	// 按字段顺序编码，字段编码和Packet的WriteXxx一致
+	BinaryMessageCodec MessageCodec = binaryMessageCodec{}
+	// 消息体为json
+	JSONMessageCodec MessageCodec = jsonMessageCodec{}
+)
+
+// 自己实现编解码的消息，例如pktgen生成的代码，BinaryMessageCodec会优先使用
+type PacketMarshaler interface {
+	Encode(pkt *Packet)
+	Decode(pkt *Packet) error
+}
+
+var sessionType = reflect.TypeOf((*Session)(nil))
+
+func NewMessageRegistry(codec MessageCodec) *MessageRegistry {
+	if codec == nil {
+		codec = BinaryMessageCodec
+	}
+	r := &MessageRegistry{
+		codec: codec,
+		types: make(map[uint32]reflect.Type),
+		ids:   make(map[reflect.Type]uint32),
+	}
+	return r
+}
+
+// 协议ID和消息结构体的映射
+type MessageRegistry struct {
+	codec MessageCodec
+	mu    sync.RWMutex
+	types map[uint32]reflect.Type // 协议ID -> 结构体类型
+	ids   map[reflect.Type]uint32 // 结构体类型 -> 协议ID
+}
+
+// 注册消息，msg为结构体指针，例如 (*LoginReq)(nil)
+func (r *MessageRegistry) Register(protoId uint32, msg interface{}) {
+	t := reflect.TypeOf(msg)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("message must be a pointer to struct, got %v", t))
+	}
+	checkProtoId(protoId)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.types[protoId] = t.Elem()
+	r.ids[t.Elem()] = protoId
+}
+
+// 消息对应的协议ID
+func (r *MessageRegistry) ProtoId(msg interface{}) (uint32, bool) {
+	t := reflect.TypeOf(msg)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	id, ok := r.ids[t]
+	return id, ok
+}
+
+// 把消息编码成带协议ID的Packet
+func (r *MessageRegistry) Encode(msg interface{}) (*Packet, error) {
+	protoId, ok := r.ProtoId(msg)
+	if !ok {
+		return nil, errors.Errorf("message %T not registered", msg)
+	}
+	pkt := NewProtoPacket(protoId)
+	if err := r.codec.Marshal(pkt, msg); err != nil {
+		pkt.Release()
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// 解码协议ID对应的消息，pkt的读索引需要指向消息体
+func (r *MessageRegistry) Decode(protoId uint32, pkt *Packet) (interface{}, error) {
+	r.mu.RLock()
+	t, ok := r.types[protoId]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("proto id %d not registered", protoId)
+	}
+	msg := reflect.New(t).Interface()
+	if err := r.codec.Unmarshal(pkt, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// 编码后发送给session
+func (r *MessageRegistry) Send(session *Session, msg interface{}) error {
+	pkt, err := r.Encode(msg)
+	if err != nil {
+		return err
+	}
+	return session.SendPacket(pkt)
+}
+
+// 把类型化的处理函数注册到router，fn形如 func(session *Session, msg *LoginReq)，
+// 协议ID由消息类型决定，消息需要先Register
+func (r *MessageRegistry) Route(router *Router, fn interface{}) {
+	fv := reflect.ValueOf(fn)
+	ft := fv.Type()
+	if ft.Kind() != reflect.Func || ft.NumIn() != 2 || ft.NumOut() != 0 || ft.In(0) != sessionType {
+		panic(fmt.Sprintf("message handler must be func(*Session, *Msg), got %v", ft))
+	}
+	protoId, ok := r.ProtoId(reflect.Zero(ft.In(1)).Interface())
+	if !ok {
+		panic(fmt.Sprintf("message %v not registered", ft.In(1)))
+	}
+	router.Register(protoId, func(session *Session, pkt *Packet) {
+		msg, err := r.Decode(protoId, pkt)
+		if err != nil {
+			log.Printf("session[%s] decode proto id:%d err:%v\n", session.StrId(), protoId, err)
+			return
+		}
+		fv.Call([]reflect.Value{reflect.ValueOf(session), reflect.ValueOf(msg)})
+	})
+}
+
+type jsonMessageCodec struct{}
+
+func (jsonMessageCodec) Marshal(pkt *Packet, msg interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrapf(err, "json marshal %T", msg)
+	}
+	pkt.WriteBytes(data)
+	return nil
+}
+
+func (jsonMessageCodec) Unmarshal(pkt *Packet, msg interface{}) error {
+	data := pkt.readableData()
+	pkt.readIndex = pkt.writeIndex
+	return errors.Wrapf(json.Unmarshal(data, msg), "json unmarshal %T", msg)
+}
+
+type binaryMessageCodec struct{}
+
+func (binaryMessageCodec) Marshal(pkt *Packet, msg interface{}) error {
+	if m, ok := msg.(PacketMarshaler); ok {
+		m.Encode(pkt)
+		return nil
+	}
+	v := reflect.ValueOf(msg)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	return marshalValue(pkt, v)
+}
+
+func (binaryMessageCodec) Unmarshal(pkt *Packet, msg interface{}) (err error) {
+	if m, ok := msg.(PacketMarshaler); ok {
+		return m.Decode(pkt)
+	}
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return errors.Errorf("unmarshal target must be a non-nil pointer, got %T", msg)
+	}
+	defer func() {
+		// 包长度不够时Packet的ReadXxx会越界
+		if r := recover(); r != nil {
+			err = errors.Errorf("unmarshal %T failed: %v", msg, r)
+		}
+	}()
+	return unmarshalValue(pkt, v.Elem())
+}
+
+func marshalValue(pkt *Packet, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		pkt.WriteBool(v.Bool())
+	case reflect.Int8:
+		pkt.WriteByte(byte(v.Int()))
+	case reflect.Uint8:
+		pkt.WriteByte(byte(v.Uint()))
+	case reflect.Int16:
+		pkt.WriteInt16(int16(v.Int()))
+	case reflect.Uint16:
+		pkt.WriteInt16(int16(v.Uint()))
+	case reflect.Int32:
+		pkt.WriteInt32(int32(v.Int()))
+	case reflect.Uint32:
+		pkt.WriteUint32(uint32(v.Uint()))
+	case reflect.Int, reflect.Int64:
+		pkt.WriteInt64(v.Int())
+	case reflect.Uint, reflect.Uint64:
+		pkt.WriteInt64(int64(v.Uint()))
+	case reflect.Float32:
+		pkt.WriteUint32(math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		pkt.WriteInt64(int64(math.Float64bits(v.Float())))
+	case reflect.String:
+		pkt.WriteString(v.String())
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			pkt.WriteStringBytes(v.Bytes())
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		pkt.WriteUint32(uint32(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := marshalValue(pkt, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		pkt.WriteUint32(uint32(v.Len()))
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := marshalValue(pkt, iter.Key()); err != nil {
+				return err
+			}
+			if err := marshalValue(pkt, iter.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		// 先写是否为空
+		pkt.WriteBool(!v.IsNil())
+		if !v.IsNil() {
+			return marshalValue(pkt, v.Elem())
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if skipField(t.Field(i)) {
+				continue
+			}
+			if err := marshalValue(pkt, v.Field(i)); err != nil {
+				return errors.WithMessagef(err, "field %s.%s", t.Name(), t.Field(i).Name)
+			}
+		}
+	default:
+		return errors.Errorf("unsupported message field type %v", v.Type())
+	}
+	return nil
+}
+
+func unmarshalValue(pkt *Packet, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(pkt.ReadBool())
+	case reflect.Int8:
+		v.SetInt(int64(int8(pkt.ReadByte())))
+	case reflect.Uint8:
+		v.SetUint(uint64(pkt.ReadByte()))
+	case reflect.Int16:
+		v.SetInt(int64(pkt.ReadInt16()))
+	case reflect.Uint16:
+		v.SetUint(uint64(uint16(pkt.ReadInt16())))
+	case reflect.Int32:
+		v.SetInt(int64(pkt.ReadInt32()))
+	case reflect.Uint32:
+		v.SetUint(uint64(pkt.ReadUint32()))
+	case reflect.Int, reflect.Int64:
+		v.SetInt(pkt.ReadInt64())
+	case reflect.Uint, reflect.Uint64:
+		v.SetUint(uint64(pkt.ReadInt64()))
+	case reflect.Float32:
+		v.SetFloat(float64(math.Float32frombits(pkt.ReadUint32())))
+	case reflect.Float64:
+		v.SetFloat(math.Float64frombits(uint64(pkt.ReadInt64())))
+	case reflect.String:
+		v.SetString(pkt.ReadString())
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes([]byte(pkt.ReadString()))
+			return nil
+		}
+		n, err := pkt.ReadCount()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+		for i := 0; i < n; i++ {
+			if err := unmarshalValue(pkt, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Array:
+		n, err := pkt.ReadCount()
+		if err != nil {
+			return err
+		}
+		if n != v.Len() {
+			return errors.Errorf("array len mismatch, want %d got %d", v.Len(), n)
+		}
+		for i := 0; i < n; i++ {
+			if err := unmarshalValue(pkt, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		n, err := pkt.ReadCount()
+		if err != nil {
+			return err
+		}
+		t := v.Type()
+		v.Set(reflect.MakeMapWithSize(t, n))
+		for i := 0; i < n; i++ {
+			key := reflect.New(t.Key()).Elem()
+			if err := unmarshalValue(pkt, key); err != nil {
+				return err
+			}
+			val := reflect.New(t.Elem()).Elem()
+			if err := unmarshalValue(pkt, val); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, val)
+		}
+	case reflect.Ptr:
+		if !pkt.ReadBool() {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		v.Set(reflect.New(v.Type().Elem()))
+		return unmarshalValue(pkt, v.Elem())
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if skipField(t.Field(i)) {
+				continue
+			}
+			if err := unmarshalValue(pkt, v.Field(i)); err != nil {
+				return errors.WithMessagef(err, "field %s.%s", t.Name(), t.Field(i).Name)
+			}
+		}
+	default:
+		return errors.Errorf("unsupported message field type %v", v.Type())
+	}
+	return nil
+}
+
+// 跳过未导出字段和 `pkt:"-"` 的字段
+func skipField(f reflect.StructField) bool {
+	return f.PkgPath != "" || f.Tag.Get("pkt") == "-"
+}
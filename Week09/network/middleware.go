@@ -0,0 +1,177 @@
+package network
+
+import (
+	"log"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 包处理中间件，包装下一个处理函数，可以在前后插入日志、鉴权、统计等通用逻辑
+type Middleware func(next PacketHandler) PacketHandler
+
+// 用中间件包装handler，mws[0]在最外层
+func Chain(handler SessionEventHandler, mws ...Middleware) SessionEventHandler {
+	c := &chainHandler{
+		SessionEventHandler: handler,
+	}
+	c.recv = handler.OnRecvPacket
+	for i := len(mws) - 1; i >= 0; i-- {
+		if mws[i] == nil {
+			continue
+		}
+		c.recv = mws[i](c.recv)
+	}
+	return c
+}
+
+type chainHandler struct {
+	SessionEventHandler
+	recv PacketHandler
+}
+
+func (c *chainHandler) OnRecvPacket(session *Session, pkt *Packet) {
+	c.recv(session, pkt)
+}
+
+func (c *chainHandler) OnIdle(session *Session) {
+	if h, ok := c.SessionEventHandler.(SessionIdleHandler); ok {
+		h.OnIdle(session)
+	}
+}
+
+func (c *chainHandler) OnShutdown(session *Session) {
+	if h, ok := c.SessionEventHandler.(SessionShutdownHandler); ok {
+		h.OnShutdown(session)
+	}
+}
+
+func (c *chainHandler) OnKick(session *Session) {
+	if h, ok := c.SessionEventHandler.(SessionKickHandler); ok {
+		h.OnKick(session)
+	}
+}
+
+// 打印每个包的处理耗时
+func Logging() Middleware {
+	return func(next PacketHandler) PacketHandler {
+		return func(session *Session, pkt *Packet) {
+			start := time.Now()
+			size := pkt.ReadableBytes()
+			next(session, pkt)
+			log.Printf("session[%s] handle packet len:%d cost:%v\n", session.StrId(), size, time.Since(start))
+		}
+	}
+}
+
+// 捕获处理函数中的panic，避免一个包把整个session搞挂
+func Recovery() Middleware {
+	return func(next PacketHandler) PacketHandler {
+		return func(session *Session, pkt *Packet) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("session[%s] handle packet panic: %v\n%s", session.StrId(), r, debug.Stack())
+				}
+			}()
+			next(session, pkt)
+		}
+	}
+}
+
+// 鉴权，check返回false时丢弃这个包
+func Auth(check func(session *Session, pkt *Packet) bool) Middleware {
+	return func(next PacketHandler) PacketHandler {
+		return func(session *Session, pkt *Packet) {
+			if !check(session, pkt) {
+				log.Printf("session[%s] packet rejected by auth\n", session.StrId())
+				return
+			}
+			next(session, pkt)
+		}
+	}
+}
+
+// 包处理统计
+type PacketMetrics struct {
+	HandledNum  uint64 // 已处理的包数
+	HandledSize uint64 // 已处理的字节数
+	CostNanos   uint64 // 总耗时
+}
+
+func (m *PacketMetrics) Snapshot() PacketMetrics {
+	return PacketMetrics{
+		HandledNum:  atomic.LoadUint64(&m.HandledNum),
+		HandledSize: atomic.LoadUint64(&m.HandledSize),
+		CostNanos:   atomic.LoadUint64(&m.CostNanos),
+	}
+}
+
+func Metrics(m *PacketMetrics) Middleware {
+	return func(next PacketHandler) PacketHandler {
+		return func(session *Session, pkt *Packet) {
+			start := time.Now()
+			atomic.AddUint64(&m.HandledSize, uint64(pkt.ReadableBytes()))
+			next(session, pkt)
+			atomic.AddUint64(&m.HandledNum, 1)
+			atomic.AddUint64(&m.CostNanos, uint64(time.Since(start)))
+		}
+	}
+}
+
+// 每个session的令牌桶限流，每秒rate个包，最多积攒burst个，超出的包直接丢弃
+func RateLimit(rate float64, burst int) Middleware {
+	var buckets sync.Map // session id -> *tokenBucket
+	return func(next PacketHandler) PacketHandler {
+		return func(session *Session, pkt *Packet) {
+			obj, ok := buckets.Load(session.Id())
+			if !ok {
+				obj, ok = buckets.LoadOrStore(session.Id(), newTokenBucket(rate, burst))
+				if !ok {
+					id := session.Id()
+					session.AddCloseHook(func(*Session) {
+						buckets.Delete(id)
+					})
+				}
+			}
+			if !obj.(*tokenBucket).take(time.Now()) {
+				log.Printf("session[%s] packet dropped by rate limit\n", session.StrId())
+				return
+			}
+			next(session, pkt)
+		}
+	}
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -2,26 +2,124 @@ package network
 
 import (
 	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
 	"github.com/valyala/bytebufferpool"
+	"io"
+	"log"
+	"runtime/debug"
+	"sync/atomic"
 )
 
 var packetEndian = binary.BigEndian // 网络字节序
 
 // -----------------消息头------------------ | ------消息体------
 // 消息长度，不含自身(uint32) | 协议ID(uint32) | 消息体(byte[])
+//
+// 协议ID的高4位是包类型，普通消息为0，所以业务协议ID不能超过MaxProtoId；
+// 非普通消息的这4字节是控制头，低28位为序号等参数，后面再跟协议ID和消息体
+// 消息长度，不含自身(uint32) | 包类型(4bit)+序号(28bit) | 协议ID(uint32) | 消息体(byte[])
 type Packet struct {
 	readIndex     uint32
 	markReadIndex uint32
 	writeIndex    uint32
 	buff          *bytebufferpool.ByteBuffer
+	kind          uint32 // 包类型
+	seq           uint32 // 请求/响应序号
+	refs          int32  // 引用计数，为0时回收
+	releaseStack  []byte // 调试模式下记录回收时的调用栈
 }
 
+const (
+	MaxProtoId uint32 = 1<<28 - 1
+
+	pktKindShift        = 28
+	pktParamMask uint32 = 1<<28 - 1
+)
+
+// 包类型
+const (
+	pktKindNormal     uint32 = iota // 普通消息
+	pktKindRequest                  // 请求，需要对端响应
+	pktKindResponse                 // 响应
+	pktKindPing                     // 心跳
+	pktKindPong                     // 心跳回应
+	pktKindHandshake                // 握手，协商压缩等功能
+	pktKindCompressed               // 压缩包，参数为压缩前的长度
+	pktKindEncrypted                // 加密包
+	pktKindClose                    // 对端请求关闭，比如WebSocket的Close帧
+)
+
+// 控制包不压缩也不加密：WebSocket要把它们转换成ping/pong/close帧，
+// 浏览器自己发的这些帧也是明文的
+func isControlKind(kind uint32) bool {
+	switch kind {
+	case pktKindPing, pktKindPong, pktKindHandshake, pktKindClose:
+		return true
+	}
+	return false
+}
+
+// 只复用缓冲区，Packet结构体不复用：过期的Release只会把引用减成负数，不会影响别的包
 func NewPacket() *Packet {
-	pkt := &Packet{}
+	pkt := &Packet{
+		refs: 1,
+	}
 	pkt.buff = bytebufferpool.Get()
+	if packetDebug {
+		atomic.AddInt64(&livePacketNum, 1)
+	}
+	return pkt
+}
+
+// 创建消息包并写入协议ID，协议ID不能超过MaxProtoId
+func NewProtoPacket(protoId uint32) *Packet {
+	checkProtoId(protoId)
+	pkt := NewPacket()
+	pkt.WriteUint32(protoId)
 	return pkt
 }
 
+// 协议ID超过MaxProtoId时高4位会被当成包类型，是调用方的错误，直接panic
+func checkProtoId(protoId uint32) {
+	if protoId > MaxProtoId {
+		panic(fmt.Sprintf("proto id %d out of range, max %d", protoId, MaxProtoId))
+	}
+}
+
+// 创建只有控制头的包
+func newControlPacket(kind uint32, param uint32) *Packet {
+	pkt := NewPacket()
+	pkt.WriteUint32(kind<<pktKindShift | param&pktParamMask)
+	return pkt
+}
+
+// 解析控制头，普通消息不动读索引
+func (p *Packet) parseHeader() {
+	p.checkModify()
+	if p.ReadableBytes() < 4 {
+		return
+	}
+	word := packetEndian.Uint32(p.buff.B[p.readIndex : p.readIndex+4])
+	kind := word >> pktKindShift
+	if kind == pktKindNormal {
+		return
+	}
+	p.kind = kind
+	p.seq = word & pktParamMask
+	p.readIndex += 4
+}
+
+// 是否是需要响应的请求
+func (p *Packet) IsRequest() bool {
+	return p.kind == pktKindRequest
+}
+
+// 请求/响应序号
+func (p *Packet) Seq() uint32 {
+	return p.seq
+}
+
 func (p *Packet) GetReadIndex() uint32 {
 	return p.readIndex
 }
@@ -31,10 +129,12 @@ func (p *Packet) GetWriteIndex() uint32 {
 }
 
 func (p *Packet) readableData() []byte {
+	p.checkAlive()
 	return p.buff.B[p.readIndex:p.writeIndex]
 }
 
 func (p *Packet) data() []byte {
+	p.checkAlive()
 	return p.buff.B[0:p.writeIndex]
 }
 
@@ -55,31 +155,120 @@ func (p *Packet) Readable() bool {
 	return p.readIndex < p.writeIndex
 }
 
+// 增加引用，同一个包要交给多个使用方时调用，每个使用方各自Release，
+// 共享期间不能再读写或者移动读写索引
+func (p *Packet) Retain() {
+	if atomic.AddInt32(&p.refs, 1) <= 1 && packetDebug {
+		panic(p.debugError("retain after release"))
+	}
+}
+
+// 释放引用，引用为0时回收缓冲区
 func (p *Packet) Release() {
+	refs := atomic.AddInt32(&p.refs, -1)
+	if refs > 0 {
+		return
+	}
+	if refs < 0 {
+		// 重复释放，缓冲区已经还回去了
+		if packetDebug {
+			panic(p.debugError("double release"))
+		}
+		atomic.AddInt64(&doubleReleaseNum, 1)
+		log.Printf("packet double release, refs:%d\n", refs)
+		return
+	}
+	if packetDebug {
+		p.releaseStack = debug.Stack()
+		atomic.AddInt64(&livePacketNum, -1)
+	}
 	bytebufferpool.Put(p.buff)
 	p.buff = nil
 }
 
+// 当前引用数
+func (p *Packet) RefCount() int32 {
+	return atomic.LoadInt32(&p.refs)
+}
+
 func (p *Packet) WriteByte(b byte) {
+	p.checkModify()
 	p.buff.WriteByte(b)
 	p.writeIndex += 1
 }
 
 func (p *Packet) ReadByte() (v byte) {
+	p.checkModify()
 	v = p.buff.B[p.readIndex]
 	p.readIndex += 1
 	return
 }
 
 func (p *Packet) GetByte(index uint32) (v byte) {
+	p.checkAlive()
 	v = p.buff.B[index]
 	return
 }
 
 func (p *Packet) SetByte(index uint32, v byte) {
+	p.checkModify()
 	p.buff.B[index] = v
 }
 
+func (p *Packet) WriteBytes(bytes []byte) {
+	p.checkModify()
+	p.buff.Write(bytes)
+	p.writeIndex += uint32(len(bytes))
+}
+
+// 从r读取n字节追加到包里，直接读进缓冲区，不经过临时的[]byte
+func (p *Packet) readFull(r io.Reader, n uint32) error {
+	p.checkModify()
+	b := p.buff.B
+	start := len(b)
+	if cap(b)-start < int(n) {
+		nb := make([]byte, start, start+int(n))
+		copy(nb, b)
+		b = nb
+	}
+	b = b[:start+int(n)]
+	if _, err := io.ReadFull(r, b[start:]); err != nil {
+		p.buff.B = b[:start]
+		return err
+	}
+	p.buff.B = b
+	p.writeIndex += n
+	return nil
+}
+
+// 和readFull一样读n字节，但缓冲区随读到的数据增长，n是对端声明的长度时用，不按它预先分配
+func (p *Packet) readFullGrow(r io.Reader, n uint32) error {
+	p.checkModify()
+	b := p.buff.B
+	start := len(b)
+	for uint32(len(b)-start) < n {
+		if len(b) == cap(b) {
+			b = append(b, 0)[:len(b)]
+		}
+		end := cap(b)
+		if max := start + int(n); end > max {
+			end = max
+		}
+		m, err := r.Read(b[len(b):end])
+		b = b[:len(b)+m]
+		if err != nil && uint32(len(b)-start) < n {
+			p.buff.B = b[:start]
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	p.buff.B = b
+	p.writeIndex += n
+	return nil
+}
+
 func (p *Packet) WriteBool(v bool) {
 	if v {
 		p.WriteByte(1)
@@ -93,18 +282,21 @@ func (p *Packet) ReadBool() (v bool) {
 }
 
 func (p *Packet) WriteInt16(v int16) {
+	p.checkModify()
 	p.buff.WriteByte(byte(v >> 8))
 	p.buff.WriteByte(byte(v))
 	p.writeIndex += 2
 }
 
 func (p *Packet) ReadInt16() (v int16) {
+	p.checkModify()
 	v = int16(packetEndian.Uint16(p.buff.B[p.readIndex : p.readIndex+2]))
 	p.readIndex += 2
 	return
 }
 
 func (p *Packet) WriteUint32(v uint32) {
+	p.checkModify()
 	p.buff.WriteByte(byte(v >> 24))
 	p.buff.WriteByte(byte(v >> 16))
 	p.buff.WriteByte(byte(v >> 8))
@@ -114,12 +306,14 @@ func (p *Packet) WriteUint32(v uint32) {
 }
 
 func (p *Packet) ReadUint32() (v uint32) {
+	p.checkModify()
 	v = packetEndian.Uint32(p.buff.B[p.readIndex : p.readIndex+4])
 	p.readIndex += 4
 	return
 }
 
 func (p *Packet) WriteInt32(v int32) {
+	p.checkModify()
 	p.buff.WriteByte(byte(v >> 24))
 	p.buff.WriteByte(byte(v >> 16))
 	p.buff.WriteByte(byte(v >> 8))
@@ -128,12 +322,14 @@ func (p *Packet) WriteInt32(v int32) {
 }
 
 func (p *Packet) ReadInt32() (v int32) {
+	p.checkModify()
 	v = int32(packetEndian.Uint32(p.buff.B[p.readIndex : p.readIndex+4]))
 	p.readIndex += 4
 	return
 }
 
 func (p *Packet) WriteInt64(v int64) {
+	p.checkModify()
 	p.buff.WriteByte(byte(v >> 56))
 	p.buff.WriteByte(byte(v >> 48))
 	p.buff.WriteByte(byte(v >> 40))
@@ -141,18 +337,20 @@ func (p *Packet) WriteInt64(v int64) {
 	p.buff.WriteByte(byte(v >> 24))
 	p.buff.WriteByte(byte(v >> 16))
 	p.buff.WriteByte(byte(v >> 8))
-	p.buff.WriteByte(byte(v >> v))
+	p.buff.WriteByte(byte(v))
 
 	p.writeIndex += 8
 }
 
 func (p *Packet) ReadInt64() (v int64) {
+	p.checkModify()
 	v = int64(packetEndian.Uint64(p.buff.B[p.readIndex : p.readIndex+8]))
 	p.readIndex += 8
 	return
 }
 
 func (p *Packet) WriteString(str string) {
+	p.checkModify()
 	bs := []byte(str)
 	len := uint32(len(bs))
 	p.WriteUint32(len + 1)
@@ -166,6 +364,7 @@ func (p *Packet) WriteString(str string) {
 }
 
 func (p *Packet) WriteStringBytes(bytes []byte) {
+	p.checkModify()
 	len := uint32(len(bytes))
 	p.WriteUint32(len + 1)
 	if len > 0 {
@@ -177,12 +376,22 @@ func (p *Packet) WriteStringBytes(bytes []byte) {
 }
 
 func (p *Packet) ReadString() (str string) {
+	p.checkModify()
 	len := p.ReadUint32()
 	str = string(p.buff.B[p.readIndex : p.readIndex+len-1])
 	p.readIndex += len
 	return
 }
 
+// 读取数组元素个数，每个元素至少1字节，超过剩余长度说明包有问题，返回错误
+func (p *Packet) ReadCount() (int, error) {
+	n := p.ReadUint32()
+	if n > p.ReadableBytes() {
+		return 0, errors.Errorf("illegal element count:%d, readable bytes:%d", n, p.ReadableBytes())
+	}
+	return int(n), nil
+}
+
 func (p *Packet) MarkReadIndex() {
 	p.markReadIndex = p.readIndex
 }
@@ -1,84 +1,115 @@
 package network
 
 import (
-	"encoding/binary"
+	"bufio"
 	"fmt"
-	"github.com/pkg/errors"
 	"io"
-	"log"
 	"net"
+	"sync"
 	"time"
 )
 
-func NewPacketConn(conn net.Conn) *PacketConn {
+func NewPacketConn(conn net.Conn, codec Codec) *PacketConn {
+	if codec == nil {
+		codec = NewDefaultCodec()
+	}
 	c := &PacketConn{
-		conn: conn,
+		conn:  conn,
+		codec: codec,
 	}
 	return c
 }
 
 type PacketConn struct {
-	conn net.Conn
+	conn   net.Conn
+	reader *bufio.Reader // 第一次读时创建，事件循环模式下不用
+	writer *bufio.Writer // 同一时间只能有一个协程写
+	codec  Codec
+
+	compressThreshold int32         // 协商开启压缩后才大于0
+	recvCompressed    int32         // 协商开启压缩后才为1，之前收到压缩包是错误
+	sendCipher        *packetCipher // 交换密钥后才有，只在握手时设置
+	recvCipher        *packetCipher
 }
 
+// 空闲连接不占用写缓冲区
+var writerPool sync.Pool
+
 func (c *PacketConn) SetRecvDeadline(deadline time.Time) error {
 	return c.conn.SetReadDeadline(deadline)
 }
 
+// 发送一个包并立即flush，发送后回收pkt
 func (c *PacketConn) SendPacket(pkt *Packet) error {
+	if err := c.WritePacket(pkt); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// 编码到写缓冲区，需要调用Flush才会真正发送，写入后回收pkt
+func (c *PacketConn) WritePacket(pkt *Packet) error {
 	defer func() {
 		pkt.Release()
 	}()
-	len := pkt.ReadableBytes()
-	log.Println("conn SendPacket start 1")
-	err := binary.Write(c.conn, binary.BigEndian, &len)
-	if err != nil {
-		return err
+	if c.writer == nil {
+		if w, ok := writerPool.Get().(*bufio.Writer); ok {
+			w.Reset(c.conn)
+			c.writer = w
+		} else {
+			c.writer = bufio.NewWriter(c.conn)
+		}
 	}
-	log.Println("conn SendPacket start 2")
-	err = writeAll(c.conn, pkt.readableData())
-	if err != nil {
-		return err
+	// 先压缩再加密，控制包原样发送
+	if !isControlKind(rawPacketKind(pkt)) {
+		pkt = c.compress(pkt)
+		if c.sendCipher != nil {
+			pkt = c.sendCipher.encrypt(pkt)
+		}
 	}
-	log.Println("conn SendPacket start 3")
-	return nil
+	return c.codec.Encode(c.writer, pkt)
 }
 
-func (c *PacketConn) ReadPacket() (*Packet, error) {
-	var (
-		err    error
-		pkt    *Packet
-		pktLen uint32
-	)
-	err = binary.Read(c.conn, binary.BigEndian, &pktLen)
-	if err != nil {
-		return nil, err
+// 把写缓冲区里的数据发出去
+func (c *PacketConn) Flush() error {
+	if c.writer == nil {
+		return nil
 	}
-	if pktLen < 1 || pktLen > 9999 {
-		return nil, errors.New(fmt.Sprintf("conn [%s] receive illegal packet len:%d, conn will closed",
-			c, pktLen))
-	}
-
-	pkt = NewPacket()
+	return c.writer.Flush()
+}
 
-	buf := make([]byte, pktLen)
-	// 读取整个消息
-	_, err = io.ReadFull(c.conn, buf[0:pktLen])
+// 写缓冲区已经flush完时还回池子
+func (c *PacketConn) releaseWriter() {
+	if c.writer != nil && c.writer.Buffered() == 0 {
+		c.writer.Reset(nil)
+		writerPool.Put(c.writer)
+		c.writer = nil
+	}
+}
 
-	pkt.buff.Write(buf)
+func (c *PacketConn) ReadPacket() (*Packet, error) {
+	if c.reader == nil {
+		c.reader = bufio.NewReader(c.conn)
+	}
+	return c.decode(c.reader)
+}
 
+// 切分出一帧，加密和压缩的包会在这里还原
+func (c *PacketConn) decode(r *bufio.Reader) (*Packet, error) {
+	pkt, err := c.codec.Decode(r)
 	if err != nil {
-		// 回收packet
-		pkt.Release()
 		return nil, err
 	}
-	pkt.SetWriteIndex(pktLen)
-
-	return pkt, nil
+	if c.recvCipher != nil && !isControlKind(rawPacketKind(pkt)) {
+		if pkt, err = c.recvCipher.decrypt(pkt); err != nil {
+			return nil, err
+		}
+	}
+	return c.decompress(pkt)
 }
 
 func (c *PacketConn) Close() error {
-	if tc, ok := c.conn.(*net.TCPConn); ok {
+	if tc, ok := tcpConnOf(c.conn); ok {
 		tc.SetLinger(0)
 	}
 	c.conn.Close()
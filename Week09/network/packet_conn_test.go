@@ -0,0 +1,81 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+)
+
+// 循环返回同一段数据，模拟源源不断的对端
+type repeatReader struct {
+	data []byte
+	off  int
+}
+
+func (r *repeatReader) Read(b []byte) (int, error) {
+	n := copy(b, r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+	return n, nil
+}
+
+// 用codec编码若干个bodySize大小的包，作为读的输入
+func encodeFrames(b *testing.B, codec Codec, bodySize int) []byte {
+	var buf bytes.Buffer
+	body := bytes.Repeat([]byte{0x5a}, bodySize)
+	for i := 0; i < 16; i++ {
+		pkt := NewProtoPacket(1)
+		pkt.WriteBytes(body)
+		if err := codec.Encode(&buf, pkt); err != nil {
+			b.Fatal(err)
+		}
+		pkt.Release()
+	}
+	return buf.Bytes()
+}
+
+func benchmarkReadPacket(b *testing.B, codec Codec, bodySize int) {
+	data := encodeFrames(b, codec, bodySize)
+	conn := NewPacketConn(nil, codec)
+	conn.reader = bufio.NewReader(&repeatReader{data: data})
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data) / 16))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pkt, err := conn.ReadPacket()
+		if err != nil {
+			b.Fatal(err)
+		}
+		pkt.Release()
+	}
+}
+
+func BenchmarkReadPacketLengthField64(b *testing.B) {
+	benchmarkReadPacket(b, NewDefaultCodec(), 64)
+}
+
+func BenchmarkReadPacketLengthField4K(b *testing.B) {
+	benchmarkReadPacket(b, NewLengthFieldCodec(4, 1<<20), 4096)
+}
+
+func BenchmarkReadPacketVarint64(b *testing.B) {
+	benchmarkReadPacket(b, NewVarintCodec(DefaultMaxFrameSize), 64)
+}
+
+func BenchmarkWritePacket64(b *testing.B) {
+	conn := NewPacketConn(nil, NewDefaultCodec())
+	conn.writer = bufio.NewWriter(io.Discard)
+	body := bytes.Repeat([]byte{0x5a}, 64)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pkt := NewProtoPacket(1)
+		pkt.WriteBytes(body)
+		if err := conn.WritePacket(pkt); err != nil {
+			b.Fatal(err)
+		}
+	}
+	conn.Flush()
+}
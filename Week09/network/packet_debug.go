@@ -0,0 +1,55 @@
+package network
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+var (
+	// 调试模式下检查重复释放、释放后使用和修改共享的包，会有额外开销
+	packetDebug      bool
+	livePacketNum    int64
+	doubleReleaseNum int64 // 非调试模式下不panic，只计数
+)
+
+// 开启包引用计数的调试检查，需要在创建任何Packet之前调用
+func SetPacketDebug(enable bool) {
+	packetDebug = enable
+}
+
+// 调试模式下未回收的包数量，用来排查泄漏
+func LivePacketNum() int64 {
+	return atomic.LoadInt64(&livePacketNum)
+}
+
+// 重复释放的次数，不为0说明有包的引用计数用错了，可以开调试模式找到位置
+func DoubleReleaseNum() int64 {
+	return atomic.LoadInt64(&doubleReleaseNum)
+}
+
+func (p *Packet) checkAlive() {
+	if packetDebug && atomic.LoadInt32(&p.refs) <= 0 {
+		panic(p.debugError("use after release"))
+	}
+}
+
+// 被多个使用方共享的包不能再修改内容和读写索引
+func (p *Packet) checkModify() {
+	if !packetDebug {
+		return
+	}
+	refs := atomic.LoadInt32(&p.refs)
+	if refs <= 0 {
+		panic(p.debugError("use after release"))
+	}
+	if refs > 1 {
+		panic(p.debugError(fmt.Sprintf("write to shared packet, refs:%d", refs)))
+	}
+}
+
+func (p *Packet) debugError(msg string) string {
+	if p.releaseStack == nil {
+		return "packet " + msg
+	}
+	return fmt.Sprintf("packet %s, released at:\n%s", msg, p.releaseStack)
+}
@@ -0,0 +1,149 @@
+package network
+
+import (
+	"log"
+	"sync"
+)
+
+// 处理某个协议号的消息，调用时pkt的读索引已经越过协议ID，指向消息体
+type PacketHandler func(session *Session, pkt *Packet)
+
+// 处理未注册的协议号
+type UnknownPacketHandler func(session *Session, protoId uint32, pkt *Packet)
+
+func NewRouter() *Router {
+	r := &Router{
+		handlers: make(map[uint32]PacketHandler),
+	}
+	return r
+}
+
+// 按协议ID分发消息，本身实现了SessionEventHandler，可以直接设置给TCPServer
+type Router struct {
+	mu              sync.RWMutex
+	handlers        map[uint32]PacketHandler
+	unknownHandler  UnknownPacketHandler
+	openHandler     func(session *Session) error
+	closeHandler    func(session *Session)
+	idleHandler     func(session *Session)
+	shutdownHandler func(session *Session)
+	kickHandler     func(session *Session)
+}
+
+// 注册协议处理函数，重复注册会覆盖之前的，协议ID超过MaxProtoId时panic
+func (r *Router) Register(protoId uint32, handler PacketHandler) {
+	checkProtoId(protoId)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if handler == nil {
+		delete(r.handlers, protoId)
+		return
+	}
+	r.handlers[protoId] = handler
+}
+
+func (r *Router) SetUnknownHandler(handler UnknownPacketHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.unknownHandler = handler
+}
+
+func (r *Router) SetOpenHandler(handler func(session *Session) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.openHandler = handler
+}
+
+func (r *Router) SetCloseHandler(handler func(session *Session)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeHandler = handler
+}
+
+func (r *Router) SetIdleHandler(handler func(session *Session)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.idleHandler = handler
+}
+
+func (r *Router) SetShutdownHandler(handler func(session *Session)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.shutdownHandler = handler
+}
+
+func (r *Router) SetKickHandler(handler func(session *Session)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.kickHandler = handler
+}
+
+func (r *Router) getHandler(protoId uint32) (PacketHandler, UnknownPacketHandler) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.handlers[protoId], r.unknownHandler
+}
+
+func (r *Router) OnOpen(session *Session) error {
+	r.mu.RLock()
+	h := r.openHandler
+	r.mu.RUnlock()
+	if h != nil {
+		return h(session)
+	}
+	return nil
+}
+
+func (r *Router) OnClose(session *Session) {
+	r.mu.RLock()
+	h := r.closeHandler
+	r.mu.RUnlock()
+	if h != nil {
+		h(session)
+	}
+}
+
+func (r *Router) OnIdle(session *Session) {
+	r.mu.RLock()
+	h := r.idleHandler
+	r.mu.RUnlock()
+	if h != nil {
+		h(session)
+	}
+}
+
+func (r *Router) OnShutdown(session *Session) {
+	r.mu.RLock()
+	h := r.shutdownHandler
+	r.mu.RUnlock()
+	if h != nil {
+		h(session)
+	}
+}
+
+func (r *Router) OnKick(session *Session) {
+	r.mu.RLock()
+	h := r.kickHandler
+	r.mu.RUnlock()
+	if h != nil {
+		h(session)
+	}
+}
+
+func (r *Router) OnRecvPacket(session *Session, pkt *Packet) {
+	if pkt.ReadableBytes() < 4 {
+		log.Printf("session[%s] receive packet without proto id, len:%d\n", session.StrId(), pkt.ReadableBytes())
+		return
+	}
+	protoId := pkt.ReadUint32()
+	handler, unknownHandler := r.getHandler(protoId)
+	if handler != nil {
+		handler(session, pkt)
+		return
+	}
+	if unknownHandler != nil {
+		unknownHandler(session, protoId, pkt)
+		return
+	}
+	log.Printf("session[%s] receive unknown proto id:%d\n", session.StrId(), protoId)
+}
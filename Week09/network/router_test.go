@@ -0,0 +1,32 @@
+package network
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegisterProtoIdOutOfRange(t *testing.T) {
+	defer func() {
+		r := recover()
+		if msg, ok := r.(string); !ok || !strings.Contains(msg, "out of range") {
+			t.Fatalf("recover %v, want out of range panic", r)
+		}
+	}()
+	// 高4位是包类型，这样的协议ID发出去会被对端当成请求包，处理函数永远收不到
+	NewRouter().Register(MaxProtoId+1, func(s *Session, pkt *Packet) {})
+}
+
+func TestNewProtoPacketMaxProtoId(t *testing.T) {
+	pkt := NewProtoPacket(MaxProtoId)
+	if rawPacketKind(pkt) != pktKindNormal {
+		t.Fatal("max proto id clashes with packet kind")
+	}
+	pkt.Release()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("proto id above MaxProtoId accepted")
+		}
+	}()
+	NewProtoPacket(MaxProtoId + 1)
+}
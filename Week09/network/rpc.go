@@ -0,0 +1,165 @@
+package network
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"sync"
+)
+
+var ErrSessionClosed = errors.New("network: session closed")
+
+// 一次请求调用，响应到达或者session关闭时通过Done通知
+type Call struct {
+	Seq   uint32
+	Reply *Packet // 响应包，读索引指向响应的协议ID，使用完需要Release
+	Error error
+	Done  chan *Call
+}
+
+// Done有1个缓冲，每个Call只会通知一次，不会阻塞
+func (c *Call) done() {
+	c.Done <- c
+}
+
+// 等待响应的请求
+type pendingCalls struct {
+	mu     sync.Mutex
+	seq    uint32
+	calls  map[uint32]*Call
+	closed bool
+}
+
+func (p *pendingCalls) add(call *Call) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	if p.calls == nil {
+		p.calls = make(map[uint32]*Call)
+	}
+	for {
+		p.seq = (p.seq + 1) & pktParamMask
+		if _, exist := p.calls[p.seq]; p.seq != 0 && !exist {
+			break
+		}
+	}
+	call.Seq = p.seq
+	p.calls[call.Seq] = call
+	return true
+}
+
+func (p *pendingCalls) remove(seq uint32) *Call {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	call := p.calls[seq]
+	delete(p.calls, seq)
+	return call
+}
+
+// session关闭时让所有等待中的请求失败
+func (p *pendingCalls) close() {
+	p.mu.Lock()
+	calls := p.calls
+	p.calls = nil
+	p.closed = true
+	p.mu.Unlock()
+	for _, call := range calls {
+		call.Error = ErrSessionClosed
+		call.done()
+	}
+}
+
+// 异步发送请求，req包含协议ID和消息体，发送后由session回收
+func (s *Session) Go(req *Packet) *Call {
+	call := &Call{
+		Done: make(chan *Call, 1),
+	}
+	if !s.calls.add(call) {
+		req.Release()
+		call.Error = ErrSessionClosed
+		call.done()
+		return call
+	}
+
+	pkt := NewPacket()
+	pkt.WriteUint32(pktKindRequest<<pktKindShift | call.Seq)
+	pkt.WriteBytes(req.readableData())
+	req.Release()
+
+	if err := s.SendPacket(pkt); err != nil {
+		// session关闭时请求已经被calls.close通知过了
+		if s.calls.remove(call.Seq) != nil {
+			call.Error = err
+			call.done()
+		}
+	}
+	return call
+}
+
+// 发送请求并等待响应，ctx超时或取消时返回ctx.Err()
+func (s *Session) Call(ctx context.Context, req *Packet) (*Packet, error) {
+	call := s.Go(req)
+	select {
+	case <-ctx.Done():
+		if s.calls.remove(call.Seq) == nil {
+			// 响应刚好到了
+			call = <-call.Done
+			if call.Reply != nil {
+				call.Reply.Release()
+			}
+		}
+		return nil, ctx.Err()
+	case call = <-call.Done:
+		return call.Reply, call.Error
+	}
+}
+
+// 响应对端的请求，resp包含协议ID和消息体，发送后由session回收
+func (s *Session) Reply(req *Packet, resp *Packet) error {
+	if !req.IsRequest() {
+		resp.Release()
+		return errors.New("network: reply to a packet that is not a request")
+	}
+
+	pkt := NewPacket()
+	pkt.WriteUint32(pktKindResponse<<pktKindShift | req.Seq())
+	pkt.WriteBytes(resp.readableData())
+	resp.Release()
+
+	return s.SendPacket(pkt)
+}
+
+// 把响应交给等待中的请求，返回false表示没有对应的请求
+func (s *Session) handleResponse(pkt *Packet) bool {
+	call := s.calls.remove(pkt.Seq())
+	if call == nil {
+		return false
+	}
+	call.Reply = pkt
+	call.done()
+	return true
+}
+
+func (c *TCPClient) Go(req *Packet) *Call {
+	session := c.Session()
+	if session == nil {
+		req.Release()
+		call := &Call{
+			Error: ErrNotConnected,
+			Done:  make(chan *Call, 1),
+		}
+		call.done()
+		return call
+	}
+	return session.Go(req)
+}
+
+func (c *TCPClient) Call(ctx context.Context, req *Packet) (*Packet, error) {
+	session := c.Session()
+	if session == nil {
+		req.Release()
+		return nil, ErrNotConnected
+	}
+	return session.Call(ctx, req)
+}
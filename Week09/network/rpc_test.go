@@ -0,0 +1,169 @@
+package network
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPendingCallsSeq(t *testing.T) {
+	var p pendingCalls
+
+	// 序号回绕时跳过0
+	p.seq = pktParamMask - 1
+	last, wrapped := &Call{}, &Call{}
+	p.add(last)
+	p.add(wrapped)
+	if last.Seq != pktParamMask || wrapped.Seq != 1 {
+		t.Fatalf("seq around wrap = %d, %d, want %d, 1", last.Seq, wrapped.Seq, pktParamMask)
+	}
+
+	// 还在等待响应的序号不会被再次分配
+	p.seq = 0
+	next := &Call{}
+	p.add(next)
+	if next.Seq != 2 {
+		t.Fatalf("seq = %d, want 2 because 1 is still pending", next.Seq)
+	}
+
+	if p.remove(wrapped.Seq) != wrapped || p.remove(wrapped.Seq) != nil {
+		t.Fatal("a call can only be removed once")
+	}
+}
+
+// 用net.Pipe连起来的一对session，server上注册的处理函数收到请求
+func startRpcPair(server *Router) (client *Session, stop func()) {
+	connA, connB := net.Pipe()
+	client = NewSession(connA, NewDefaultTcpOptions())
+	client.SetEventHandler(NewRouter())
+	serverSession := NewSession(connB, NewDefaultTcpOptions())
+	serverSession.SetEventHandler(server)
+	ctx, cancel := context.WithCancel(context.Background())
+	go client.StartServe(ctx)
+	go serverSession.StartServe(ctx)
+	return client, func() {
+		cancel()
+		client.Close()
+		serverSession.Close()
+	}
+}
+
+func rpcRequest(body string) *Packet {
+	req := NewProtoPacket(1)
+	req.WriteString(body)
+	return req
+}
+
+// 请求在处理函数返回后就被回收，要留到后面回复的请求需要复制一份
+func copyRequest(pkt *Packet) *Packet {
+	copied := NewPacket()
+	copied.WriteBytes(pkt.data())
+	copied.parseHeader()
+	copied.ReadUint32()
+	return copied
+}
+
+func TestCallResponsesOutOfOrder(t *testing.T) {
+	// 收齐两个请求之后倒序回复
+	var held *Packet
+	server := NewRouter()
+	server.Register(1, func(s *Session, pkt *Packet) {
+		if held == nil {
+			held = copyRequest(pkt)
+			return
+		}
+		for _, req := range []*Packet{pkt, held} {
+			resp := NewProtoPacket(2)
+			resp.WriteString(req.ReadString())
+			s.Reply(req, resp)
+		}
+		held.Release()
+	})
+	client, stop := startRpcPair(server)
+	defer stop()
+
+	a := client.Go(rpcRequest("a"))
+	b := client.Go(rpcRequest("b"))
+	for _, want := range []struct {
+		call *Call
+		body string
+	}{{a, "a"}, {b, "b"}} {
+		select {
+		case call := <-want.call.Done:
+			if call.Error != nil {
+				t.Fatal(call.Error)
+			}
+			if id, body := call.Reply.ReadUint32(), call.Reply.ReadString(); id != 2 || body != want.body {
+				t.Errorf("call %d got %d %q, want 2 %q", call.Seq, id, body, want.body)
+			}
+			call.Reply.Release()
+		case <-time.After(time.Second):
+			t.Fatalf("call %q timeout", want.body)
+		}
+	}
+}
+
+func TestCallTimeoutDropsLateResponse(t *testing.T) {
+	release := make(chan struct{})
+	server := NewRouter()
+	server.Register(1, func(s *Session, pkt *Packet) {
+		body := pkt.ReadString()
+		if body == "slow" {
+			<-release
+		}
+		resp := NewProtoPacket(2)
+		resp.WriteString(body)
+		s.Reply(pkt, resp)
+	})
+	client, stop := startRpcPair(server)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	resp, err := client.Call(ctx, rpcRequest("slow"))
+	cancel()
+	if err != context.DeadlineExceeded || resp != nil {
+		t.Fatalf("slow call = %v, %v, want deadline exceeded", resp, err)
+	}
+	if len(client.calls.calls) != 0 {
+		t.Fatalf("timed out call still pending")
+	}
+
+	// 超时的响应到达后被丢掉，不会串到下一个请求上
+	close(release)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err = client.Call(ctx, rpcRequest("fast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Release()
+	if resp.ReadUint32(); resp.ReadString() != "fast" {
+		t.Fatal("late response delivered to the next call")
+	}
+}
+
+func TestCallSessionClosed(t *testing.T) {
+	server := NewRouter()
+	server.Register(1, func(s *Session, pkt *Packet) {
+		// 不回复
+	})
+	client, stop := startRpcPair(server)
+	defer stop()
+
+	pending := client.Go(rpcRequest("pending"))
+	client.Close()
+	select {
+	case call := <-pending.Done:
+		if call.Error != ErrSessionClosed {
+			t.Errorf("pending call err = %v, want %v", call.Error, ErrSessionClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending call not failed on close")
+	}
+
+	_, err := client.Call(context.Background(), rpcRequest("after close"))
+	if err != ErrSessionClosed {
+		t.Errorf("call after close err = %v, want %v", err, ErrSessionClosed)
+	}
+}
@@ -0,0 +1,16 @@
+package network
+
+import "github.com/pkg/errors"
+
+var ErrSendQueueFull = errors.New("network: send queue full")
+
+// 发送队列满时的处理策略
+type SendPolicy int
+
+const (
+	SendBlock        SendPolicy = iota // 一直等到队列有空位
+	SendBlockTimeout                   // 最多等SendTimeout，超时丢弃
+	SendDropNewest                     // 丢弃正在发送的包
+	SendDropOldest                     // 丢弃队列里最早的包
+	SendDisconnect                     // 断开消费太慢的连接
+)
@@ -12,20 +12,44 @@ import (
 
 var sessionId uint32
 
+// 一次最多合并写入的包数，避免队列一直有包时迟迟不flush
+const maxWriteBatch = 128
+
 type SessionPool interface {
 	GetSession(sid string) *Session
 }
 
-func NewSession(conn net.Conn) *Session {
+func NewSession(conn net.Conn, opts *TcpOptions) *Session {
+	if opts == nil {
+		opts = NewDefaultTcpOptions()
+	}
+	return newSession(conn, opts, opts.frameCodec(opts.Codec))
+}
+
+func newSession(conn net.Conn, opts *TcpOptions, codec Codec) *Session {
+	inQueueSize, outQueueSize := opts.InQueueSize, opts.OutQueueSize
+	if inQueueSize <= 0 {
+		inQueueSize = 100
+	}
+	if outQueueSize <= 0 {
+		outQueueSize = 100
+	}
 	id := newSessionId()
 	strId := strconv.Itoa((int)(id))
 	s := &Session{
 		id:         id,
 		strId:      strId,
-		conn:       NewPacketConn(conn),
-		inMsgCh:    make(chan *Packet, 100),
-		outMsgCh:   make(chan *Packet, 100),
+		conn:       NewPacketConn(conn, codec),
+		opts:       opts,
+		outMsgCh:   make(chan *Packet, outQueueSize),
 		cronPeriod: 1 * time.Second,
+		closeCh:    make(chan struct{}),
+		drainCh:    make(chan struct{}),
+		flushCh:    make(chan struct{}),
+	}
+	if opts.WorkerPool == nil {
+		// WorkerPool模式下收到的包直接交给工作协程，不需要接收队列
+		s.inMsgCh = make(chan *Packet, inQueueSize)
 	}
 	return s
 }
@@ -36,17 +60,40 @@ func newSessionId() uint32 {
 
 type Session struct {
 	conn               *PacketConn
+	opts               *TcpOptions
 	inMsgCh            chan *Packet
 	outMsgCh           chan *Packet
 	handler            SessionEventHandler
 	closeOnce          sync.Once
-	closeFlag          bool
+	closeCh            chan struct{} // Close时关闭
+	drainOnce          sync.Once
+	drainCh            chan struct{} // 开始优雅关闭时关闭
+	flushCh            chan struct{} // 通知写协程写完队列后退出
+	closeHooksMu       sync.Mutex
+	closeHooks         []func(s *Session)
+	closeHooksDone     bool
+	calls              pendingCalls // 等待响应的请求
+	lazyWrite          bool         // 事件循环模式，有包要发时才启动写协程
+	writing            int32        // 是否已经有写协程
+	writeMu            sync.Mutex   // 保证同一时间只有一个协程在写
+	stopRead           func()       // 事件循环模式下优雅关闭时停止读取
+	authMu             sync.RWMutex
+	userId             string      // 认证通过的用户ID
+	principal          interface{} // 认证时带出的用户信息
+	kicked             int32       // 被重复登录踢下线
+	peerClosed         int32       // 对端请求关闭
+	attrs              sync.Map    // 业务自定义的属性
+	ctxMu              sync.Mutex
+	ctx                context.Context // 关闭时cancel，用到时才创建
+	cancelCtx          context.CancelFunc
 	id                 uint32
 	strId              string
 	cronPeriod         time.Duration
 	CronCounter        uint16
-	HandledPacketNum   int       // 已处理的包数
-	LastRecvPacketTime time.Time // 最近一次收到消息的时间，用来检查客户端是否掉线了
+	lastPingTime       time.Time
+	HandledPacketNum   int    // 已处理的包数
+	droppedPacketNum   uint64 // 发送队列满被丢弃的包数
+	lastRecvPacketTime int64  // 最近一次收到包的时间(UnixNano)，读协程更新，用来检查客户端是否掉线了
 }
 
 func (s *Session) SetEventHandler(handler SessionEventHandler) {
@@ -77,6 +124,11 @@ func (s *Session) StartServe(ctx context.Context) {
 
 	defer s.Close()
 
+	if s.opts.WorkerPool != nil {
+		s.serveWithPool(subCtx)
+		return
+	}
+
 	var (
 		inMsg *Packet
 		err   error
@@ -89,25 +141,50 @@ func (s *Session) StartServe(ctx context.Context) {
 		}
 	}
 
-	subErrChan := make(chan error)
+	subErrChan := make(chan error, 1)
+	writeDone := make(chan struct{})
 
+	s.touchRecvTime()
 	go s.loopRead(subCtx, subErrChan)
 
-	go s.loopWrite(subCtx)
+	go s.loopWrite(subCtx, writeDone)
+
+	cronTicker := s.opts.clock().NewTicker(s.cronPeriod)
+	defer cronTicker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-s.closeCh:
+			return
 		case err = <-subErrChan:
-			s.conn.Close()
+			if isTimeoutErr(err) {
+				s.onIdle()
+			}
 			return
 		case inMsg = <-s.inMsgCh:
-			s.recvPacket(inMsg)
+			s.handlePacket(inMsg)
+		case <-cronTicker.C():
+			s.CronCounter++
+			if !s.onCron() {
+				return
+			}
+		case <-s.drainCh:
+			s.drain(subErrChan, writeDone)
+			return
 		}
 	}
 }
 
+func (s *Session) handlePacket(pkt *Packet) {
+	if s.handleControlPacket(pkt) {
+		return
+	}
+	s.recvPacket(pkt)
+	s.HandledPacketNum++
+}
+
 func (s *Session) recvPacket(pkt *Packet) {
 	defer func() {
 		if pkt != nil {
@@ -120,55 +197,210 @@ func (s *Session) recvPacket(pkt *Packet) {
 	}
 }
 
+// 优雅关闭：停止读取，处理完已经收到的包，等写协程把发送队列写完
+func (s *Session) drain(readErrChan <-chan error, writeDone <-chan struct{}) {
+	s.notifyShutdown()
+
+	// 让读协程从阻塞的读里返回
+	s.conn.SetRecvDeadline(time.Now())
+	for reading := true; reading; {
+		select {
+		case <-s.closeCh:
+			return
+		case pkt := <-s.inMsgCh:
+			s.handlePacket(pkt)
+		case <-readErrChan:
+			reading = false
+		}
+	}
+	for pending := true; pending; {
+		select {
+		case pkt := <-s.inMsgCh:
+			s.handlePacket(pkt)
+		default:
+			pending = false
+		}
+	}
+
+	close(s.flushCh)
+	select {
+	case <-s.closeCh:
+	case <-writeDone:
+	}
+}
+
+// 开始优雅关闭，session处理完已收到的包并把发送队列写完后自动Close
+func (s *Session) Shutdown() {
+	s.drainOnce.Do(func() {
+		close(s.drainCh)
+		if s.stopRead != nil {
+			s.stopRead()
+		} else if s.opts.WorkerPool != nil {
+			// 没有服务协程来处理drainCh，直接让读协程从阻塞的读里返回
+			s.conn.SetRecvDeadline(time.Now())
+		}
+	})
+}
+
+// 对端请求的关闭不是服务器要关闭，不回调OnShutdown
+func (s *Session) notifyShutdown() {
+	if atomic.LoadInt32(&s.peerClosed) == 1 {
+		return
+	}
+	if h, ok := s.handler.(SessionShutdownHandler); ok {
+		h.OnShutdown(s)
+	}
+}
+
+func (s *Session) isDraining() bool {
+	select {
+	case <-s.drainCh:
+		return true
+	default:
+		return false
+	}
+}
+
 func (s *Session) loopRead(ctx context.Context, errChan chan<- error) {
-	var (
-		pkt *Packet
-		err error
-	)
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
 		}
-		pkt, err = s.conn.ReadPacket()
+		pkt, err := s.readPacket()
 		if err != nil {
 			errChan <- err
 			return
 		}
-		s.inMsgCh <- pkt
-		s.LastRecvPacketTime = time.Now()
+		if pkt == nil {
+			continue
+		}
+
+		select {
+		case s.inMsgCh <- pkt:
+		case <-s.closeCh:
+			pkt.Release()
+			return
+		}
 	}
 
 }
 
-func (s *Session) loopWrite(ctx context.Context) {
-	defer func() {
-		// log.NetLogger.Infof("session[id=%s in=%d out=%d] loopWrite coroutine exit", s.strId, len(s.inMsgCh), len(s.outMsgCh))
-	}()
-	var (
-		pkt *Packet
-		ok  bool
-	)
+// 读一个包，响应包直接交给等待的调用方，这时返回nil
+func (s *Session) readPacket() (*Packet, error) {
+	if s.opts.ReadTimeout > 0 {
+		// 空闲检测由cron负责，这里多留一个cron周期兜底，保证读协程不会一直阻塞
+		s.conn.SetRecvDeadline(time.Now().Add(s.opts.ReadTimeout + s.cronPeriod))
+		if s.isDraining() {
+			// 不能覆盖掉优雅关闭时设置的超时
+			s.conn.SetRecvDeadline(time.Now())
+		}
+	}
+	pkt, err := s.conn.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	return s.preparePacket(pkt), nil
+}
+
+// 解析控制头，响应包直接交给等待的调用方，这时返回nil
+func (s *Session) preparePacket(pkt *Packet) *Packet {
+	// 包括响应和控制包在内，收到任何包都说明对端还活着
+	s.touchRecvTime()
+	pkt.parseHeader()
+	if pkt.kind == pktKindResponse {
+		// 响应直接在读协程里交给调用方，避免handler里同步调用时死锁
+		if !s.handleResponse(pkt) {
+			log.Printf("session[%s] receive response without request, seq:%d\n", s.strId, pkt.Seq())
+			pkt.Release()
+		}
+		return nil
+	}
+	return pkt
+}
+
+func (s *Session) loopWrite(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case pkt, ok = <-s.outMsgCh:
-			if !ok {
+		case <-s.closeCh:
+			return
+		case pkt := <-s.outMsgCh:
+			if !s.writeBatch(pkt) {
 				return
 			}
-			err := s.conn.SendPacket(pkt)
-			if err != nil {
-				return
+		case <-s.flushCh:
+			for {
+				select {
+				case pkt := <-s.outMsgCh:
+					if !s.writeBatch(pkt) {
+						return
+					}
+				default:
+					return
+				}
 			}
 		}
 	}
 }
 
+// 写入pkt和队列里已有的包，整批只flush一次
+func (s *Session) writeBatch(pkt *Packet) bool {
+	err := s.conn.WritePacket(pkt)
+	for n := 1; err == nil && n < maxWriteBatch; n++ {
+		select {
+		case pkt = <-s.outMsgCh:
+			err = s.conn.WritePacket(pkt)
+			continue
+		default:
+		}
+		break
+	}
+	if err == nil {
+		err = s.conn.Flush()
+	}
+	if err != nil {
+		log.Printf("session[%s] send packet err:%v\n", s.strId, err)
+		// 让读协程也退出
+		s.conn.Close()
+		return false
+	}
+	return true
+}
+
+// 添加关闭回调，在OnClose之前调用，已经关闭的话立即调用
+func (s *Session) AddCloseHook(hook func(s *Session)) {
+	s.closeHooksMu.Lock()
+	if !s.closeHooksDone {
+		s.closeHooks = append(s.closeHooks, hook)
+		s.closeHooksMu.Unlock()
+		return
+	}
+	s.closeHooksMu.Unlock()
+	hook(s)
+}
+
+func (s *Session) runCloseHooks() {
+	s.closeHooksMu.Lock()
+	hooks := s.closeHooks
+	s.closeHooks = nil
+	s.closeHooksDone = true
+	s.closeHooksMu.Unlock()
+	for _, hook := range hooks {
+		hook(s)
+	}
+}
+
 func (s *Session) Close() {
 	s.closeOnce.Do(func() {
+		close(s.closeCh)
+		s.cancelContext()
 		s.conn.Close()
+		s.calls.close()
+		s.runCloseHooks()
 		if s.handler != nil {
 			s.handler.OnClose(s)
 		}
@@ -176,12 +408,95 @@ func (s *Session) Close() {
 	})
 }
 
-func (s *Session) SendPacket(pkt *Packet) {
-	if s.closeFlag {
+// 放入发送队列，发送后由session回收；队列满时按SendPolicy处理，
+// 包被丢弃时返回ErrSendQueueFull，session已关闭返回ErrSessionClosed
+func (s *Session) SendPacket(pkt *Packet) error {
+	err := s.enqueue(pkt)
+	if err == nil && s.lazyWrite {
+		s.startWrite()
+	}
+	return err
+}
+
+func (s *Session) enqueue(pkt *Packet) error {
+	select {
+	case <-s.closeCh:
 		pkt.Release()
-		return
+		return ErrSessionClosed
+	default:
+	}
+	select {
+	case s.outMsgCh <- pkt:
+		return nil
+	default:
+	}
+
+	switch s.opts.SendPolicy {
+	case SendBlockTimeout:
+		timer := time.NewTimer(s.opts.SendTimeout)
+		defer timer.Stop()
+		select {
+		case <-s.closeCh:
+			pkt.Release()
+			return ErrSessionClosed
+		case s.outMsgCh <- pkt:
+			return nil
+		case <-timer.C:
+		}
+	case SendDropOldest:
+		for {
+			select {
+			case old := <-s.outMsgCh:
+				old.Release()
+				atomic.AddUint64(&s.droppedPacketNum, 1)
+			default:
+			}
+			select {
+			case <-s.closeCh:
+				pkt.Release()
+				return ErrSessionClosed
+			case s.outMsgCh <- pkt:
+				return nil
+			default:
+			}
+		}
+	case SendDisconnect:
+		log.Printf("session[%s] send queue full, disconnect\n", s.strId)
+		// 让读协程退出，由服务协程关闭session
+		s.conn.Close()
+	case SendDropNewest:
+	default:
+		select {
+		case <-s.closeCh:
+			pkt.Release()
+			return ErrSessionClosed
+		case s.outMsgCh <- pkt:
+			return nil
+		}
 	}
-	s.outMsgCh <- pkt
+
+	pkt.Release()
+	atomic.AddUint64(&s.droppedPacketNum, 1)
+	return ErrSendQueueFull
+}
+
+// 发送队列满被丢弃的包数
+func (s *Session) DroppedPacketNum() uint64 {
+	return atomic.LoadUint64(&s.droppedPacketNum)
+}
+
+// 最近一次收到包的时间
+func (s *Session) LastRecvPacketTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastRecvPacketTime))
+}
+
+func (s *Session) touchRecvTime() {
+	atomic.StoreInt64(&s.lastRecvPacketTime, s.opts.clock().Now().UnixNano())
+}
+
+// session关闭时返回的chan会被关闭
+func (s *Session) Done() <-chan struct{} {
+	return s.closeCh
 }
 
 func (s *Session) Id() uint32 {
@@ -204,14 +519,16 @@ func (s *Session) GetCurrentWriteQSize() int {
 	return len(s.outMsgCh)
 }
 
+// 回收队列里剩下的包，队列不关闭，避免并发发送时panic
 func (s *Session) clear() {
-	s.closeFlag = true
-	close(s.outMsgCh)
-	close(s.inMsgCh)
-	for m := range s.outMsgCh {
-		m.Release()
-	}
-	for m := range s.inMsgCh {
-		m.Release()
+	for {
+		select {
+		case m := <-s.outMsgCh:
+			m.Release()
+		case m := <-s.inMsgCh:
+			m.Release()
+		default:
+			return
+		}
 	}
 }
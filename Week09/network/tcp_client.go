@@ -0,0 +1,219 @@
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/pkg/errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrNotConnected = errors.New("network: client not connected")
+
+// 重连间隔的下限
+const minReconnectInterval = 10 * time.Millisecond
+
+func NewTcpClient(remoteAddr string, opt ...TcpOption) *TCPClient {
+	opts := NewDefaultTcpOptions()
+	for _, o := range opt {
+		if o == nil {
+			continue
+		}
+		o(opts)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &TCPClient{
+		addr:   remoteAddr,
+		opts:   opts,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	return c
+}
+
+// TCP客户端，和TCPServer使用同样的封包格式和Session，断线后可以自动重连
+type TCPClient struct {
+	addr         string
+	eventHandler SessionEventHandler
+	opts         *TcpOptions
+	tlsConfig    *tls.Config
+	mu           sync.RWMutex
+	session      *Session
+	ctx          context.Context
+	cancel       context.CancelFunc
+	stopOnce     sync.Once
+}
+
+func (c *TCPClient) SetSessionEventHandler(eventHandler SessionEventHandler) {
+	c.eventHandler = eventHandler
+}
+
+// 建立连接，首次连接失败直接返回错误，之后断线按配置自动重连
+func (c *TCPClient) Start() error {
+	tlsConfig, err := c.opts.loadTLSConfig(false)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil && tlsConfig.ServerName == "" && !tlsConfig.InsecureSkipVerify {
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(c.addr)
+	}
+	c.tlsConfig = tlsConfig
+
+	session, err := c.dial()
+	if err != nil {
+		return err
+	}
+	// Start返回后就能发包
+	c.setSession(session)
+
+	go c.loopServe(session)
+
+	log.Printf("tcp client[%s] started \n", c.addr)
+	return nil
+}
+
+func (c *TCPClient) dial() (*Session, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if c.opts.Dialer != nil {
+		conn, err = c.opts.Dialer(c.ctx, c.opts.Network, c.addr)
+	} else {
+		dialer := net.Dialer{Timeout: c.opts.DialTimeout}
+		conn, err = dialer.DialContext(c.ctx, c.opts.Network, c.addr)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "tcp client dial [%s] failed", c.addr)
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(true)
+	}
+	if c.tlsConfig != nil {
+		conn = tls.Client(conn, c.tlsConfig)
+		if err = tlsHandshake(conn, c.opts.HandshakeTimeout); err != nil {
+			conn.Close()
+			return nil, errors.Wrapf(err, "tcp client tls handshake with [%s] failed", c.addr)
+		}
+	}
+
+	session := NewSession(conn, c.opts)
+	session.SetEventHandler(c)
+	if err = session.startHandshake(); err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "tcp client handshake with [%s] failed", c.addr)
+	}
+	return session, nil
+}
+
+func (c *TCPClient) loopServe(session *Session) {
+	for session != nil {
+		c.setSession(session)
+		session.StartServe(c.ctx)
+		c.clearSession(session)
+
+		if !c.opts.Reconnect {
+			return
+		}
+		session = c.reconnect()
+	}
+}
+
+// 按退避间隔重连，客户端关闭时返回nil
+func (c *TCPClient) reconnect() *Session {
+	interval := c.opts.ReconnectMinInterval
+	if interval < minReconnectInterval {
+		// 间隔为0时不会翻倍，一直连不上会空转
+		interval = minReconnectInterval
+	}
+	maxInterval := c.opts.ReconnectMaxInterval
+	if maxInterval < interval {
+		maxInterval = interval
+	}
+	for {
+		select {
+		case <-c.ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+
+		session, err := c.dial()
+		if err == nil {
+			log.Printf("tcp client[%s] reconnected \n", c.addr)
+			return session
+		}
+		log.Printf("tcp client reconnect failed, retry after %v: %v\n", interval, err)
+
+		interval *= 2
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
+
+func (c *TCPClient) setSession(session *Session) {
+	c.mu.Lock()
+	c.session = session
+	c.mu.Unlock()
+}
+
+func (c *TCPClient) clearSession(session *Session) {
+	c.mu.Lock()
+	if c.session == session {
+		c.session = nil
+	}
+	c.mu.Unlock()
+}
+
+// 当前连接，未连上时返回nil
+func (c *TCPClient) Session() *Session {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.session
+}
+
+func (c *TCPClient) SendPacket(pkt *Packet) error {
+	session := c.Session()
+	if session == nil {
+		pkt.Release()
+		return ErrNotConnected
+	}
+	return session.SendPacket(pkt)
+}
+
+func (c *TCPClient) Stop() {
+	c.stopOnce.Do(func() {
+		c.cancel()
+		if session := c.Session(); session != nil {
+			session.Close()
+		}
+		log.Printf("tcp client[%s] stopped \n", c.addr)
+	})
+}
+
+func (c *TCPClient) OnOpen(session *Session) error {
+	if c.eventHandler != nil {
+		return c.eventHandler.OnOpen(session)
+	}
+	return nil
+}
+
+func (c *TCPClient) OnRecvPacket(session *Session, pkt *Packet) {
+	if c.eventHandler != nil {
+		c.eventHandler.OnRecvPacket(session, pkt)
+	}
+}
+
+func (c *TCPClient) OnIdle(session *Session) {
+	if h, ok := c.eventHandler.(SessionIdleHandler); ok {
+		h.OnIdle(session)
+	}
+}
+
+func (c *TCPClient) OnClose(session *Session) {
+	if c.eventHandler != nil {
+		c.eventHandler.OnClose(session)
+	}
+}
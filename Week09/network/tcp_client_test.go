@@ -0,0 +1,37 @@
+package network
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReconnectZeroInterval(t *testing.T) {
+	var (
+		dials  int32
+		server net.Conn
+	)
+	dialer := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if atomic.AddInt32(&dials, 1) > 1 {
+			return nil, errors.New("refused")
+		}
+		var client net.Conn
+		server, client = net.Pipe()
+		return client, nil
+	}
+	c := NewTcpClient("pipe", WithDialer(dialer), WithReconnect(0, time.Second))
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	// 断线后一直连不上，间隔为0也不能空转
+	server.Close()
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&dials); n < 2 || n > 6 {
+		t.Fatalf("dialed %d times in 100ms", n)
+	}
+}
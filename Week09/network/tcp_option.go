@@ -1,9 +1,29 @@
 package network
 
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
 func NewDefaultTcpOptions() *TcpOptions {
 	opts := &TcpOptions{
+		Network:           "tcp",
 		ConnReadBuffSize:  1024 * 1024,
 		ConnWriteBuffSize: 1024 * 1024,
+		Codec:             NewDefaultCodec(),
+		HandshakeTimeout:  10 * time.Second,
+		Clock:             SystemClock,
+		InQueueSize:       100,
+		OutQueueSize:      100,
+
+		WebSocketMaxMessageSize: DefaultMaxFrameSize,
+
+		DialTimeout:          5 * time.Second,
+		ReconnectMinInterval: 1 * time.Second,
+		ReconnectMaxInterval: 30 * time.Second,
 	}
 	return opts
 }
@@ -11,6 +31,225 @@ func NewDefaultTcpOptions() *TcpOptions {
 type TcpOption func(*TcpOptions)
 
 type TcpOptions struct {
+	Network           string // tcp、tcp4、unix等，见net.Listen
 	ConnReadBuffSize  int
 	ConnWriteBuffSize int
+	Codec             Codec  // 消息帧编解码
+	MaxFrameSize      uint32 // 最大包长，为0时用Codec自己的，Codec需要实现FrameSizeLimiter
+	Clock             Clock  // 定时检查和心跳用的时钟
+	CompressThreshold int    // 大于0时和对端协商压缩，不少于这个长度的包压缩后发送
+	Encryption        bool   // 握手时用ECDH交换密钥，之后除心跳等控制包外都加密，双方都要开启
+
+	// 收发队列
+	InQueueSize  int           // 接收队列长度
+	OutQueueSize int           // 发送队列长度
+	SendPolicy   SendPolicy    // 发送队列满时的处理策略
+	SendTimeout  time.Duration // SendBlockTimeout策略的最长等待时间
+	WorkerPool   *WorkerPool   // 不为空时收到的包交给工作协程池处理，同一个session保证顺序
+
+	// TLS，设置了TLSConfig或者证书文件时开启
+	TLSConfig        *tls.Config
+	TLSCertFile      string
+	TLSKeyFile       string
+	TLSCAFile        string        // 服务器用来校验客户端证书，客户端用来校验服务器证书
+	HandshakeTimeout time.Duration // TLS握手、交换密钥和读WebSocket请求头的超时
+
+	// 心跳，为0表示不开启
+	HeartbeatInterval time.Duration // 发送ping的间隔
+	ReadTimeout       time.Duration // 超过这个时间没收到任何包则认为连接空闲，关闭session
+
+	// 以下仅服务器使用，为0表示不限制
+	MaxConns      int           // 最大连接数
+	MaxConnsPerIP int           // 单个IP最大连接数
+	AcceptRate    float64       // 每秒最多accept的连接数
+	AcceptBurst   int           // accept速率的突发上限
+	AdmissionHook AdmissionHook // 创建Session前的准入检查
+	Authenticator Authenticator // 不为空时session认证通过后才把包交给SessionEventHandler
+	EventLoops    int           // 大于0时用epoll事件循环读取连接，仅Linux，不支持TLS
+
+	// WebSocket
+	WebSocketMaxMessageSize uint32                     // 单个消息最大长度
+	WebSocketCheckOrigin    func(r *http.Request) bool // 检查Origin，为空时不检查
+
+	// 以下仅客户端使用
+	Dialer               func(ctx context.Context, network, addr string) (net.Conn, error) // 自定义建立连接，为空时用net.Dialer
+	DialTimeout          time.Duration                                                     // 连接超时
+	Reconnect            bool                                                              // 断线后是否自动重连
+	ReconnectMinInterval time.Duration                                                     // 重连间隔，每次失败翻倍，小于10ms按10ms
+	ReconnectMaxInterval time.Duration                                                     // 重连间隔上限
+}
+
+// 监听和连接使用的网络类型，例如unix
+func WithNetwork(network string) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.Network = network
+	}
+}
+
+// 替换时钟，一般只在测试时使用
+func WithClock(clock Clock) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.Clock = clock
+	}
+}
+
+func WithCodec(codec Codec) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.Codec = codec
+	}
+}
+
+// 开启压缩，客户端连上后先握手，对端也支持时不少于threshold字节的包用flate压缩，
+// 不支持握手的老客户端不受影响
+func WithCompression(threshold int) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.CompressThreshold = threshold
+	}
+}
+
+// 不能用TLS时的应用层加密，服务器开启后不再接受没有加密的客户端
+func WithEncryption() TcpOption {
+	return func(opts *TcpOptions) {
+		opts.Encryption = true
+	}
+}
+
+// 修改最大包长，对WithCodec设置的编解码同样有效
+func WithMaxFrameSize(maxFrameSize uint32) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.MaxFrameSize = maxFrameSize
+	}
+}
+
+// 按MaxFrameSize修改最大包长后的编解码
+func (opts *TcpOptions) frameCodec(codec Codec) Codec {
+	if opts.MaxFrameSize == 0 {
+		return codec
+	}
+	if limiter, ok := codec.(FrameSizeLimiter); ok && limiter.MaxFrameSize() != opts.MaxFrameSize {
+		return limiter.WithMaxFrameSize(opts.MaxFrameSize)
+	}
+	return codec
+}
+
+// 限制最大连接数和单个IP的最大连接数
+func WithMaxConns(maxConns, maxConnsPerIP int) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.MaxConns = maxConns
+		opts.MaxConnsPerIP = maxConnsPerIP
+	}
+}
+
+// 限制每秒accept的连接数
+func WithAcceptRate(rate float64, burst int) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.AcceptRate = rate
+		opts.AcceptBurst = burst
+	}
+}
+
+func WithAdmissionHook(hook AdmissionHook) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.AdmissionHook = hook
+	}
+}
+
+// 开启认证，同一个用户重复登录时踢掉旧的session
+func WithAuthenticator(authenticator Authenticator) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.Authenticator = authenticator
+	}
+}
+
+func WithTLSConfig(config *tls.Config) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.TLSConfig = config
+	}
+}
+
+// 从文件加载证书和私钥
+func WithTLSFiles(certFile, keyFile string) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.TLSCertFile = certFile
+		opts.TLSKeyFile = keyFile
+	}
+}
+
+// 服务器开启双向认证，客户端必须提供caFile签发的证书；客户端用caFile校验服务器证书
+func WithTLSCA(caFile string) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.TLSCAFile = caFile
+	}
+}
+
+func WithWebSocketCheckOrigin(check func(r *http.Request) bool) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.WebSocketCheckOrigin = check
+	}
+}
+
+func WithDialer(dialer func(ctx context.Context, network, addr string) (net.Conn, error)) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.Dialer = dialer
+	}
+}
+
+func WithDialTimeout(timeout time.Duration) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.DialTimeout = timeout
+	}
+}
+
+// 开启断线重连，重连间隔从minInterval开始每次失败翻倍，最大maxInterval
+func WithReconnect(minInterval, maxInterval time.Duration) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.Reconnect = true
+		opts.ReconnectMinInterval = minInterval
+		opts.ReconnectMaxInterval = maxInterval
+	}
+}
+
+// 收发队列的长度
+func WithQueueSize(inQueueSize, outQueueSize int) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.InQueueSize = inQueueSize
+		opts.OutQueueSize = outQueueSize
+	}
+}
+
+// 发送队列满时的处理策略，timeout只对SendBlockTimeout有效
+func WithSendPolicy(policy SendPolicy, timeout time.Duration) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.SendPolicy = policy
+		opts.SendTimeout = timeout
+	}
+}
+
+// 收到的包交给pool处理，不再每个session一个处理协程，pool需要使用方自己Stop
+func WithWorkerPool(pool *WorkerPool) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.WorkerPool = pool
+	}
+}
+
+// 使用n个epoll事件循环代替每个连接的读写协程，适合大量空闲连接，
+// 没有指定WorkerPool时服务器会按CPU数创建一个
+func WithEventLoop(n int) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.EventLoops = n
+	}
+}
+
+// 每隔interval发送一次ping，对端会自动回pong
+func WithHeartbeat(interval time.Duration) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.HeartbeatInterval = interval
+	}
+}
+
+// 超过timeout没收到任何包则关闭session
+func WithReadTimeout(timeout time.Duration) TcpOption {
+	return func(opts *TcpOptions) {
+		opts.ReadTimeout = timeout
+	}
 }
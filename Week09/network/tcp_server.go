@@ -2,10 +2,15 @@ package network
 
 import (
 	"context"
+	"crypto/tls"
 	"github.com/orcaman/concurrent-map"
+	"github.com/pkg/errors"
 	"log"
 	"net"
+	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 func NewTcpServer(listenAddr string, opt ...TcpOption) *TCPServer {
@@ -16,10 +21,17 @@ func NewTcpServer(listenAddr string, opt ...TcpOption) *TCPServer {
 		}
 		o(opts)
 	}
+	ctx, cancel := context.WithCancel(context.Background())
 	s := &TCPServer{
-		addr:     listenAddr,
-		sessions: cmap.New(),
-		opts:     opts,
+		addr:       listenAddr,
+		sessions:   cmap.New(),
+		users:      cmap.New(),
+		opts:       opts,
+		ctx:        ctx,
+		cancel:     cancel,
+		acceptDone: make(chan struct{}),
+		admission:  newAdmission(opts),
+		groups:     newGroupManager(),
 	}
 	return s
 }
@@ -30,70 +42,195 @@ type TCPServer struct {
 	eventHandler SessionEventHandler
 	opts         *TcpOptions
 	sessions     cmap.ConcurrentMap
-	stopFlag     bool
+	users        cmap.ConcurrentMap // 用户ID -> 认证通过的session
+	stopFlag     int32
 	stopOnce     sync.Once
+	connMu       sync.Mutex // 保护stopFlag的设置和sessionWg.Add
+	ctx          context.Context
+	cancel       context.CancelFunc
+	acceptDone   chan struct{}  // accept协程退出时关闭
+	sessionWg    sync.WaitGroup // 所有session的服务协程
+	admission    *admission
+	groups       *groupManager
+	wsServersMu  sync.Mutex
+	wsServers    []*http.Server
+	loops        []*eventLoop
+	nextLoop     uint32
+	ownPool      *WorkerPool // 事件循环模式下没有指定WorkerPool时自己创建的
 }
 
 func (s *TCPServer) Start() (err error) {
 
-	s.ln, err = net.Listen("tcp", s.addr)
+	ln, err := listen(s.opts.Network, s.addr)
 	if err != nil {
 		return err
 	}
+	if err = s.StartListener(ln); err != nil {
+		ln.Close()
+	}
+	return
+}
 
-	go func() {
-
-		for {
-			closeChan := make(chan struct{})
-			go s.loopAccept(closeChan)
-
-			select {
-			case <-closeChan:
-				if s.stopFlag {
-					return
-				}
-			}
+// 在已有的listener上提供服务，可以是unix socket、systemd传进来的fd或者测试用的内存listener
+func (s *TCPServer) StartListener(ln net.Listener) error {
+	tlsConfig, err := s.opts.loadTLSConfig(true)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		if s.opts.EventLoops > 0 {
+			return errors.New("network: event loop does not support tls")
 		}
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	if err = s.startEventLoops(); err != nil {
+		return err
+	}
+	if s.addr == "" {
+		s.addr = ln.Addr().String()
+	}
+	s.ln = ln
 
-	}()
+	go s.loopAccept()
 
 	log.Printf("tcp server[%s] started \n", s.addr)
 
-	return
+	return nil
 }
 
-func (s *TCPServer) loopAccept(closeCh chan struct{}) {
+// 实际监听的地址，监听":0"时可以拿到系统分配的端口
+func (s *TCPServer) Addr() net.Addr {
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Addr()
+}
+
+func (s *TCPServer) isStopped() bool {
+	return atomic.LoadInt32(&s.stopFlag) == 1
+}
+
+// TCP和WebSocket连接都在这里登记，开始关闭后返回false，
+// 保证Shutdown里sessionWg.Wait之后不会再Add
+func (s *TCPServer) addConn() bool {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if s.isStopped() {
+		return false
+	}
+	s.sessionWg.Add(1)
+	return true
+}
+
+func (s *TCPServer) loopAccept() {
 	defer func() {
-		close(closeCh) // 通知退出
+		close(s.acceptDone) // 通知退出
 	}()
 
-	ctx, cancel := context.WithCancel(context.Background())
-
+	var tempDelay time.Duration
 	for {
 		conn, err := s.ln.Accept()
 
 		if err != nil {
-			if s.stopFlag {
-				cancel()
+			if s.isStopped() {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// 句柄不够之类的临时错误，等一会再试，避免空转
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else if tempDelay *= 2; tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+				log.Printf("tcp server[%s] accept err: %v, retrying in %v\n", s.addr, err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
 			}
+			log.Printf("tcp server[%s] accept err: %v, stop accepting\n", s.addr, err)
+			return
+		}
+		tempDelay = 0
+
+		ip, err := s.admission.admit(conn)
+		if err != nil {
+			log.Printf("tcp server[%s] reject conn from %s: %v\n", s.addr, conn.RemoteAddr(), err)
+			conn.Close()
 			continue
 		}
 
-		go s.handleNewConn(ctx, conn)
+		if !s.addConn() {
+			s.admission.release(ip)
+			conn.Close()
+			continue
+		}
+		go s.handleNewConn(s.ctx, conn, func() {
+			s.admission.release(ip)
+			s.sessionWg.Done()
+		})
 	}
 }
 
-func (s *TCPServer) handleNewConn(ctx context.Context, conn net.Conn) {
-	// 设置socket参数
-	tcpConn := conn.(*net.TCPConn)
-	//tcpConn.SetWriteBuffer(s.opts.ConnWriteBuffSize)
-	//tcpConn.SetReadBuffer(s.opts.ConnReadBuffSize)
-	tcpConn.SetNoDelay(true)
+// done在连接处理结束后调用，事件循环模式下是在session关闭时
+func (s *TCPServer) handleNewConn(ctx context.Context, conn net.Conn, done func()) {
+	if len(s.loops) > 0 {
+		if s.opts.AdmissionHook != nil {
+			if err := s.opts.AdmissionHook(conn); err != nil {
+				log.Printf("tcp server[%s] reject conn from %s: %v\n", s.addr, conn.RemoteAddr(), err)
+				conn.Close()
+				done()
+				return
+			}
+		}
+		if tcpConn, ok := tcpConnOf(conn); ok {
+			tcpConn.SetNoDelay(true)
+		}
+		s.serveConnInLoop(conn, done)
+		return
+	}
+	defer done()
 
-	session := NewSession(conn)
+	if s.opts.AdmissionHook != nil {
+		if err := s.opts.AdmissionHook(conn); err != nil {
+			log.Printf("tcp server[%s] reject conn from %s: %v\n", s.addr, conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+
+	// 设置socket参数，TLS等包装过的连接取底层的TCP连接
+	if tcpConn, ok := tcpConnOf(conn); ok {
+		//tcpConn.SetWriteBuffer(s.opts.ConnWriteBuffSize)
+		//tcpConn.SetReadBuffer(s.opts.ConnReadBuffSize)
+		tcpConn.SetNoDelay(true)
+	}
+
+	// 先完成TLS握手，OnOpen里就能拿到客户端证书
+	if err := tlsHandshake(conn, s.opts.HandshakeTimeout); err != nil {
+		log.Printf("tcp server[%s] tls handshake with %s failed: %v\n", s.addr, conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	s.serveConn(ctx, conn, s.opts.frameCodec(s.opts.Codec))
+}
+
+// 创建session并开始服务，直到连接关闭
+func (s *TCPServer) serveConn(ctx context.Context, conn net.Conn, codec Codec) {
+	session := newSession(conn, s.opts, codec)
 	session.SetEventHandler(s)
+	if s.opts.Encryption {
+		if err := session.serverKeyExchange(); err != nil {
+			log.Printf("tcp server[%s] key exchange with %s failed: %v\n", s.addr, conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
 
 	s.sessions.Set(session.StrId(), session)
+	if s.isStopped() {
+		// 关服过程中刚好连进来的，直接走优雅关闭
+		session.Shutdown()
+	}
 
 	session.StartServe(ctx)
 }
@@ -110,12 +247,72 @@ func (s *TCPServer) GetSession(sid string) *Session {
 	return obj.(*Session)
 }
 
+// 当前连接数
+func (s *TCPServer) SessionCount() int {
+	return s.sessions.Count()
+}
+
+// 立即关闭，所有连接直接断开，需要等连接处理完用Shutdown
 func (s *TCPServer) Stop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Shutdown(ctx)
+}
+
+// 优雅关闭：停止accept，通知所有session处理完已收到的包并写完发送队列，
+// ctx到期后强制关闭剩下的session，返回被强制关闭的session数
+func (s *TCPServer) Shutdown(ctx context.Context) (dropped int, err error) {
 	s.stopOnce.Do(func() {
-		s.stopFlag = true
-		s.ln.Close()
-		log.Printf("tcp server[%s] stopped \n", s.addr)
+		s.connMu.Lock()
+		atomic.StoreInt32(&s.stopFlag, 1)
+		s.connMu.Unlock()
+		if s.ln != nil {
+			s.ln.Close()
+		} else {
+			close(s.acceptDone)
+		}
+		s.wsServersMu.Lock()
+		for _, httpServer := range s.wsServers {
+			httpServer.Close()
+		}
+		s.wsServersMu.Unlock()
 	})
+
+	// 设置stopFlag后sessionWg就不会再增加了，等accept协程退出
+	<-s.acceptDone
+	for item := range s.sessions.IterBuffered() {
+		item.Val.(*Session).Shutdown()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.sessionWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		// 卡在handler里的session关闭后不再等它返回
+		for item := range s.sessions.IterBuffered() {
+			item.Val.(*Session).Close()
+			dropped++
+		}
+	}
+	s.cancel()
+	s.stopEventLoops()
+	if s.ownPool != nil {
+		if dropped == 0 {
+			s.ownPool.Stop()
+		} else {
+			// 可能有任务卡住，不等它
+			go s.ownPool.Stop()
+		}
+	}
+
+	log.Printf("tcp server[%s] stopped, %d sessions dropped \n", s.addr, dropped)
+	return
 }
 
 func (s *TCPServer) OnOpen(session *Session) error {
@@ -126,13 +323,37 @@ func (s *TCPServer) OnOpen(session *Session) error {
 }
 
 func (s *TCPServer) OnRecvPacket(session *Session, pkt *Packet) {
+	if s.opts.Authenticator != nil && !session.IsAuthenticated() {
+		s.authenticate(session, pkt)
+		return
+	}
 	if s.eventHandler != nil {
 		s.eventHandler.OnRecvPacket(session, pkt)
 	}
 }
 
+func (s *TCPServer) OnIdle(session *Session) {
+	if h, ok := s.eventHandler.(SessionIdleHandler); ok {
+		h.OnIdle(session)
+	}
+}
+
+func (s *TCPServer) OnShutdown(session *Session) {
+	if session.isKicked() {
+		if h, ok := s.eventHandler.(SessionKickHandler); ok {
+			h.OnKick(session)
+		}
+		return
+	}
+	if h, ok := s.eventHandler.(SessionShutdownHandler); ok {
+		h.OnShutdown(session)
+	}
+}
+
 func (s *TCPServer) OnClose(session *Session) {
 	s.sessions.Remove(session.strId)
+	s.unbindUser(session)
+	s.groups.leaveAll(session)
 
 	if s.eventHandler != nil {
 		s.eventHandler.OnClose(session)
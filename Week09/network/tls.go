@@ -0,0 +1,113 @@
+package network
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// 加载TLS配置，没有配置TLS时返回nil
+// 服务器：TLSCAFile用于校验客户端证书（双向认证）
+// 客户端：TLSCAFile用于校验服务器证书，证书文件作为客户端证书
+func (opts *TcpOptions) loadTLSConfig(isServer bool) (*tls.Config, error) {
+	if opts.TLSConfig == nil && opts.TLSCertFile == "" && opts.TLSCAFile == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{}
+	if opts.TLSConfig != nil {
+		cfg = opts.TLSConfig.Clone()
+	}
+	if opts.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load tls certificate")
+		}
+		cfg.Certificates = append(cfg.Certificates, cert)
+	}
+	if opts.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(opts.TLSCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load tls ca")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificate found in %s", opts.TLSCAFile)
+		}
+		if isServer {
+			cfg.ClientCAs = pool
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			cfg.RootCAs = pool
+		}
+	}
+	if isServer && cfg.ClientAuth >= tls.VerifyClientCertIfGiven && cfg.ClientCAs == nil {
+		// ClientCAs为空时crypto/tls用系统根证书校验客户端证书，任何公共CA签发的证书都能通过，
+		// 不是想要的双向认证，必须明确指定CA
+		return nil, errors.New("tls client auth requires ClientCAs")
+	}
+	return cfg, nil
+}
+
+// 在连接上完成TLS握手，非TLS连接直接返回
+func tlsHandshake(conn net.Conn, timeout time.Duration) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	if timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+		defer tlsConn.SetDeadline(time.Time{})
+	}
+	return tlsConn.Handshake()
+}
+
+// 取出底层的TCP连接，TLS等包装过的连接也能拿到
+func tcpConnOf(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, true
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// TLS连接的状态，非TLS连接返回false
+func (c *PacketConn) TLSState() (tls.ConnectionState, bool) {
+	// WebSocket的连接外面还包了一层，和tcpConnOf一样往里拆
+	conn := c.conn
+	for {
+		switch wrapped := conn.(type) {
+		case *tls.Conn:
+			return wrapped.ConnectionState(), true
+		case interface{ NetConn() net.Conn }:
+			conn = wrapped.NetConn()
+		default:
+			return tls.ConnectionState{}, false
+		}
+	}
+}
+
+// 对端证书链，双向认证时服务器可以拿到客户端证书
+func (s *Session) PeerCertificates() []*x509.Certificate {
+	state, ok := s.conn.TLSState()
+	if !ok {
+		return nil
+	}
+	return state.PeerCertificates
+}
+
+// 对端证书的CommonName，没有证书时返回空
+func (s *Session) PeerIdentity() string {
+	certs := s.PeerCertificates()
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.CommonName
+}
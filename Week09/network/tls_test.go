@@ -0,0 +1,186 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 测试用的CA，签发的证书和私钥写到dir下的文件里
+type testCA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, name+".pem"), "CERTIFICATE", der)
+	return &testCA{dir: dir, cert: cert, key: key}
+}
+
+func (ca *testCA) file() string {
+	return filepath.Join(ca.dir, ca.cert.Subject.CommonName+".pem")
+}
+
+// 签发证书，返回证书和私钥文件
+func (ca *testCA) issue(t *testing.T, commonName string, serial int64) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(ca.dir, commonName+".crt")
+	keyFile = filepath.Join(ca.dir, commonName+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, file, typ string, der []byte) {
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 双向认证的服务器，收到协议1时把对端的身份和TLS状态交给peers
+func startMutualTLSServer(t *testing.T, ca *testCA) (*TCPServer, chan *Session) {
+	certFile, keyFile := ca.issue(t, "server", 2)
+	server := NewTcpServer("127.0.0.1:0", WithTLSFiles(certFile, keyFile), WithTLSCA(ca.file()))
+	peers := make(chan *Session, 1)
+	r := NewRouter()
+	r.Register(1, func(s *Session, pkt *Packet) {
+		peers <- s
+	})
+	server.SetSessionEventHandler(r)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Stop)
+	return server, peers
+}
+
+func TestMutualTLSPeerIdentity(t *testing.T) {
+	ca := newTestCA(t, t.TempDir(), "test-ca")
+	server, peers := startMutualTLSServer(t, ca)
+
+	certFile, keyFile := ca.issue(t, "alice", 3)
+	client := NewTcpClient(server.Addr().String(), WithTLSFiles(certFile, keyFile), WithTLSCA(ca.file()))
+	client.SetSessionEventHandler(NewRouter())
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	client.SendPacket(NewProtoPacket(1))
+
+	var s *Session
+	select {
+	case s = <-peers:
+	case <-time.After(time.Second):
+		t.Fatal("server did not receive packet over mutual TLS")
+	}
+	if id := s.PeerIdentity(); id != "alice" {
+		t.Errorf("server sees peer %q, want alice", id)
+	}
+	state, ok := s.conn.TLSState()
+	if !ok || !state.HandshakeComplete || len(state.VerifiedChains) == 0 {
+		t.Errorf("server tls state %v handshake %v chains %d", ok, state.HandshakeComplete, len(state.VerifiedChains))
+	}
+	if id := client.Session().PeerIdentity(); id != "server" {
+		t.Errorf("client sees peer %q, want server", id)
+	}
+}
+
+func TestMutualTLSRejectsUntrustedClient(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "test-ca")
+	server, peers := startMutualTLSServer(t, ca)
+
+	other := newTestCA(t, dir, "other-ca")
+	certFile, keyFile := other.issue(t, "mallory", 4)
+	for _, opts := range [][]TcpOption{
+		{WithTLSFiles(certFile, keyFile), WithTLSCA(ca.file())},
+		{WithTLSCA(ca.file())}, // 不带客户端证书
+	} {
+		client := NewTcpClient(server.Addr().String(), opts...)
+		closed := make(chan struct{})
+		r := NewRouter()
+		r.SetCloseHandler(func(s *Session) {
+			close(closed)
+		})
+		client.SetSessionEventHandler(r)
+		// TLS1.3里客户端先完成握手，服务器拒绝证书后再断开，Start可能成功也可能失败
+		if err := client.Start(); err == nil {
+			client.SendPacket(NewProtoPacket(1))
+			select {
+			case <-closed:
+			case <-time.After(time.Second):
+				t.Fatal("untrusted client not disconnected")
+			}
+		}
+		client.Stop()
+	}
+	select {
+	case s := <-peers:
+		t.Fatalf("server accepted packet from %q", s.PeerIdentity())
+	default:
+	}
+}
+
+func TestClientAuthRequiresClientCAs(t *testing.T) {
+	opts := NewDefaultTcpOptions()
+	WithTLSConfig(&tls.Config{ClientAuth: tls.RequireAndVerifyClientCert})(opts)
+	if _, err := opts.loadTLSConfig(true); err == nil {
+		t.Fatal("client auth without ClientCAs accepted")
+	}
+	// 客户端不校验ClientAuth
+	if _, err := opts.loadTLSConfig(false); err != nil {
+		t.Fatal(err)
+	}
+}
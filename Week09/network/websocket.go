@@ -0,0 +1,418 @@
+package network
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RFC 6455
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// 在addr上启动WebSocket服务，path下的连接和TCP连接共用同一个SessionEventHandler，
+// 每个二进制消息就是一个Packet
+func (s *TCPServer) StartWebSocket(addr, path string) error {
+	tlsConfig, err := s.opts.loadTLSConfig(true)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, s.WebSocketHandler())
+	httpServer := &http.Server{
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+		// 慢速发送请求头的连接不能一直占着
+		ReadHeaderTimeout: s.opts.HandshakeTimeout,
+	}
+	s.wsServersMu.Lock()
+	s.wsServers = append(s.wsServers, httpServer)
+	s.wsServersMu.Unlock()
+
+	go func() {
+		if tlsConfig != nil {
+			err = httpServer.ServeTLS(ln, "", "")
+		} else {
+			err = httpServer.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("websocket server[%s] stopped: %v\n", addr, err)
+		}
+	}()
+
+	log.Printf("websocket server[%s%s] started \n", addr, path)
+	return nil
+}
+
+// 升级成WebSocket连接的http.Handler，可以挂到已有的http服务上
+func (s *TCPServer) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(s.serveWebSocket)
+}
+
+func (s *TCPServer) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	// 和TCP连接走同一个登记，开始关闭后不再接受新连接
+	if !s.addConn() {
+		http.Error(w, "server stopped", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.sessionWg.Done()
+
+	if s.opts.WebSocketCheckOrigin != nil && !s.opts.WebSocketCheckOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	key, err := checkWebSocketRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("websocket hijack from %s failed: %v\n", r.RemoteAddr, err)
+		return
+	}
+
+	ip, err := s.admission.admit(conn)
+	if err != nil {
+		log.Printf("tcp server[%s] reject websocket conn from %s: %v\n", s.addr, conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	defer s.admission.release(ip)
+
+	if s.opts.AdmissionHook != nil {
+		if err := s.opts.AdmissionHook(conn); err != nil {
+			log.Printf("tcp server[%s] reject websocket conn from %s: %v\n", s.addr, conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAcceptKey(key) + "\r\n\r\n"
+	if _, err = rw.WriteString(resp); err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if tcpConn, ok := tcpConnOf(conn); ok {
+		tcpConn.SetNoDelay(true)
+	}
+
+	// 握手时可能多读了客户端的数据，后续从rw.Reader里读
+	conn = &bufferedConn{Conn: conn, reader: rw.Reader}
+	s.serveConn(s.ctx, conn, newWebSocketCodec(s.opts.WebSocketMaxMessageSize))
+}
+
+func checkWebSocketRequest(r *http.Request) (string, error) {
+	if r.Method != http.MethodGet {
+		return "", errors.New("websocket: method not GET")
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		return "", errors.New("websocket: not a websocket upgrade request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return "", errors.New("websocket: unsupported version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return "", errors.New("websocket: missing Sec-WebSocket-Key")
+	}
+	return key, nil
+}
+
+func headerContains(header http.Header, name, value string) bool {
+	for _, v := range header[name] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func webSocketAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsAcceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// 先读hijack时缓冲的数据
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// 关闭帧的状态码
+const (
+	wsCloseProtocolError   = 1002
+	wsCloseUnsupportedData = 1003
+	wsCloseMessageTooBig   = 1009
+)
+
+// 对端违反协议，需要回一个带状态码的Close帧再关闭连接
+type wsProtocolError struct {
+	code uint16
+	err  error
+}
+
+func (e *wsProtocolError) Error() string {
+	return e.err.Error()
+}
+
+func newWebSocketCodec(maxMessageSize uint32) *webSocketCodec {
+	if maxMessageSize == 0 {
+		maxMessageSize = DefaultMaxFrameSize
+	}
+	return &webSocketCodec{
+		maxMessageSize: maxMessageSize,
+	}
+}
+
+// 服务端WebSocket帧编解码，一个二进制消息对应一个Packet；
+// ping/pong帧转换成心跳控制包，close帧转换成关闭控制包，由Session统一处理。
+// 解码时记录了分片消息的状态，每个连接用自己的codec
+type webSocketCodec struct {
+	maxMessageSize uint32
+	fragmented     bool   // 正在接收分片消息
+	message        []byte // 已经收到的分片
+	closed         bool   // 收到或者要发出Close帧，之后的数据都丢掉
+}
+
+func (c *webSocketCodec) MaxFrameSize() uint32 {
+	return c.maxMessageSize
+}
+
+func (c *webSocketCodec) WithMaxFrameSize(maxFrameSize uint32) Codec {
+	return newWebSocketCodec(maxFrameSize)
+}
+
+func (c *webSocketCodec) Encode(w io.Writer, pkt *Packet) error {
+	data := pkt.readableData()
+	opcode := byte(wsOpBinary)
+	if len(data) >= 4 {
+		switch packetEndian.Uint32(data) >> pktKindShift {
+		case pktKindPing:
+			opcode, data = wsOpPing, data[4:]
+		case pktKindPong:
+			opcode, data = wsOpPong, data[4:]
+		case pktKindClose:
+			opcode, data = wsOpClose, data[4:]
+		}
+	}
+	if uint32(len(data)) > c.maxMessageSize {
+		return errors.Wrapf(ErrFrameTooLarge, "encode websocket message len:%d", len(data))
+	}
+
+	// 服务端发的帧不加掩码
+	var header [10]byte
+	header[0] = 0x80 | opcode
+	n := 2
+	switch {
+	case len(data) < 126:
+		header[1] = byte(len(data))
+	case len(data) <= 0xFFFF:
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:], uint16(len(data)))
+		n = 4
+	default:
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(len(data)))
+		n = 10
+	}
+	if err := writeAll(w, header[:n]); err != nil {
+		return err
+	}
+	return writeAll(w, data)
+}
+
+func (c *webSocketCodec) Decode(r *bufio.Reader) (*Packet, error) {
+	if c.closed {
+		// 等Session回完Close帧后关闭连接，期间对端发来的都不处理
+		_, err := io.Copy(ioutil.Discard, r)
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	for {
+		fin, opcode, payload, err := c.readFrame(r)
+		if err != nil {
+			if protocolErr, ok := err.(*wsProtocolError); ok {
+				return c.closeWithError(protocolErr), nil
+			}
+			return nil, err
+		}
+
+		if opcode&0x8 != 0 {
+			// 控制帧可以插在分片消息中间，分片的状态留到下次Decode继续
+			return c.decodeControl(fin, opcode, payload), nil
+		}
+		switch opcode {
+		case wsOpBinary:
+			if c.fragmented {
+				return c.closeWithError(&wsProtocolError{wsCloseProtocolError, errors.New("websocket: new message before previous finished")}), nil
+			}
+			if !fin {
+				c.fragmented = true
+				c.message = append(c.message[:0], payload...)
+				continue
+			}
+		case wsOpContinuation:
+			if !c.fragmented {
+				return c.closeWithError(&wsProtocolError{wsCloseProtocolError, errors.New("websocket: unexpected continuation frame")}), nil
+			}
+			c.message = append(c.message, payload...)
+			if length := len(c.message); uint32(length) > c.maxMessageSize {
+				return c.closeWithError(&wsProtocolError{wsCloseMessageTooBig, errors.Wrapf(ErrFrameTooLarge, "decode websocket message len:%d", length)}), nil
+			}
+			if !fin {
+				continue
+			}
+			payload = c.message
+			c.fragmented = false
+			c.message = nil
+		case wsOpText:
+			return c.closeWithError(&wsProtocolError{wsCloseUnsupportedData, errors.New("websocket: text message not supported")}), nil
+		default:
+			return c.closeWithError(&wsProtocolError{wsCloseProtocolError, errors.Errorf("websocket: unsupported opcode %d", opcode)}), nil
+		}
+
+		if len(payload) == 0 {
+			return nil, errors.New("websocket: empty message")
+		}
+		pkt := NewPacket()
+		pkt.WriteBytes(payload)
+		return pkt, nil
+	}
+}
+
+// ping/pong转换成心跳包，close转换成关闭包，Session回一个Close帧后关闭连接
+func (c *webSocketCodec) decodeControl(fin bool, opcode byte, payload []byte) *Packet {
+	if !fin || len(payload) > 125 {
+		return c.closeWithError(&wsProtocolError{wsCloseProtocolError, errors.Errorf("websocket: invalid control frame, opcode %d fin %v len %d", opcode, fin, len(payload))})
+	}
+	var kind uint32
+	switch opcode {
+	case wsOpPing:
+		kind = pktKindPing
+	case wsOpPong:
+		kind = pktKindPong
+	case wsOpClose:
+		if len(payload) == 1 {
+			return c.closeWithError(&wsProtocolError{wsCloseProtocolError, errors.New("websocket: close frame with 1 byte payload")})
+		}
+		kind = pktKindClose
+		c.closed = true
+	default:
+		return c.closeWithError(&wsProtocolError{wsCloseProtocolError, errors.Errorf("websocket: unsupported opcode %d", opcode)})
+	}
+	ctrl := newControlPacket(kind, 0)
+	ctrl.WriteBytes(payload)
+	return ctrl
+}
+
+// 转换成带状态码的关闭包，和对端发来的Close一样由Session回给对端后关闭连接
+func (c *webSocketCodec) closeWithError(err *wsProtocolError) *Packet {
+	log.Printf("websocket protocol error, close with %d: %v\n", err.code, err.err)
+	c.closed = true
+	c.fragmented = false
+	c.message = nil
+	ctrl := newControlPacket(pktKindClose, 0)
+	ctrl.WriteInt16(int16(err.code))
+	return ctrl
+}
+
+// 读一帧，返回去掉掩码后的数据，数据在下次读之前有效
+func (c *webSocketCodec) readFrame(r *bufio.Reader) (fin bool, opcode byte, payload []byte, err error) {
+	var header [8]byte
+	if _, err = io.ReadFull(r, header[:2]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	if header[0]&0x70 != 0 {
+		// 没有协商任何扩展，RSV位必须为0
+		err = &wsProtocolError{wsCloseProtocolError, errors.New("websocket: reserved bits set")}
+		return
+	}
+	masked := header[1]&0x80 != 0
+	if !masked {
+		err = &wsProtocolError{wsCloseProtocolError, errors.New("websocket: client frame not masked")}
+		return
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		if _, err = io.ReadFull(r, header[:2]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(header[:2]))
+	case 127:
+		if _, err = io.ReadFull(r, header[:8]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(header[:8])
+	}
+	if length > uint64(c.maxMessageSize) {
+		err = &wsProtocolError{wsCloseMessageTooBig, errors.Wrapf(ErrFrameTooLarge, "websocket frame len:%d", length)}
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
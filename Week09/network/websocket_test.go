@@ -0,0 +1,369 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 客户端发的帧，masked为false时构造不合法的未加掩码帧
+func clientFrame(fin bool, opcode byte, payload []byte, masked bool) []byte {
+	var b bytes.Buffer
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	b.WriteByte(first)
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		b.WriteByte(maskBit | byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		b.WriteByte(maskBit | 126)
+		binary.Write(&b, binary.BigEndian, uint16(len(payload)))
+	default:
+		b.WriteByte(maskBit | 127)
+		binary.Write(&b, binary.BigEndian, uint64(len(payload)))
+	}
+	if !masked {
+		b.Write(payload)
+		return b.Bytes()
+	}
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	b.Write(mask[:])
+	for i, c := range payload {
+		b.WriteByte(c ^ mask[i%4])
+	}
+	return b.Bytes()
+}
+
+func frames(frames ...[]byte) *bufio.Reader {
+	return bufio.NewReader(bytes.NewReader(bytes.Join(frames, nil)))
+}
+
+// 检查解码出来的是带状态码的关闭包
+func expectWsClose(t *testing.T, pkt *Packet, err error, code uint16) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("decode err %v, want close %d", err, code)
+	}
+	defer pkt.Release()
+	pkt.parseHeader()
+	if pkt.kind != pktKindClose || pkt.ReadableBytes() != 2 {
+		t.Fatalf("decode kind %d len %d, want close packet", pkt.kind, pkt.ReadableBytes())
+	}
+	if got := uint16(pkt.ReadInt16()); got != code {
+		t.Fatalf("close code %d, want %d", got, code)
+	}
+}
+
+func TestWebSocketCodecMasking(t *testing.T) {
+	c := newWebSocketCodec(0)
+	pkt, err := c.Decode(frames(clientFrame(true, wsOpBinary, []byte("hello mask"), true)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(pkt.readableData()); got != "hello mask" {
+		t.Fatalf("unmasked payload %q", got)
+	}
+	pkt.Release()
+
+	// 客户端的帧必须加掩码
+	c = newWebSocketCodec(0)
+	pkt, err = c.Decode(frames(clientFrame(true, wsOpBinary, []byte("plain"), false)))
+	expectWsClose(t, pkt, err, wsCloseProtocolError)
+}
+
+func TestWebSocketCodecFragmentation(t *testing.T) {
+	c := newWebSocketCodec(0)
+	r := frames(
+		clientFrame(false, wsOpBinary, []byte("ab"), true),
+		clientFrame(true, wsOpPing, []byte("p"), true),
+		clientFrame(false, wsOpContinuation, []byte("cd"), true),
+		clientFrame(true, wsOpContinuation, []byte("ef"), true),
+	)
+
+	// 分片中间的ping先交出去，消息收齐后再返回
+	ping, err := c.Decode(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsPingPacket(ping) {
+		t.Fatal("ping between fragments not delivered")
+	}
+	ping.parseHeader()
+	if got := string(ping.readableData()); got != "p" {
+		t.Fatalf("ping payload %q", got)
+	}
+	ping.Release()
+
+	pkt, err := c.Decode(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(pkt.readableData()); got != "abcdef" {
+		t.Fatalf("reassembled %q, want abcdef", got)
+	}
+	pkt.Release()
+
+	// 没有开始的分片消息不能有continuation
+	pkt, err = newWebSocketCodec(0).Decode(frames(clientFrame(true, wsOpContinuation, []byte("x"), true)))
+	expectWsClose(t, pkt, err, wsCloseProtocolError)
+
+	// 上一条消息没收完不能开始新消息
+	pkt, err = newWebSocketCodec(0).Decode(frames(
+		clientFrame(false, wsOpBinary, []byte("a"), true),
+		clientFrame(true, wsOpBinary, []byte("b"), true),
+	))
+	expectWsClose(t, pkt, err, wsCloseProtocolError)
+}
+
+func TestWebSocketCodecInvalidControlFrames(t *testing.T) {
+	for name, frame := range map[string][]byte{
+		"fragmented ping": clientFrame(false, wsOpPing, nil, true),
+		"ping over 125":   clientFrame(true, wsOpPing, bytes.Repeat([]byte{1}, 126), true),
+		"close over 125":  clientFrame(true, wsOpClose, bytes.Repeat([]byte{1}, 126), true),
+		"reserved opcode": clientFrame(true, 0xB, nil, true),
+	} {
+		c := newWebSocketCodec(0)
+		r := frames(frame, clientFrame(true, wsOpBinary, []byte("after"), true))
+		pkt, err := c.Decode(r)
+		if err != nil || pkt == nil {
+			t.Fatalf("%s: decode %v", name, err)
+		}
+		expectWsClose(t, pkt, err, wsCloseProtocolError)
+		// 之后的数据都不再处理
+		if pkt, err = c.Decode(r); err == nil {
+			pkt.Release()
+			t.Fatalf("%s: frame decoded after protocol error", name)
+		}
+	}
+}
+
+func TestWebSocketCodecOversize(t *testing.T) {
+	c := newWebSocketCodec(16)
+	pkt, err := c.Decode(frames(clientFrame(true, wsOpBinary, bytes.Repeat([]byte{1}, 17), true)))
+	expectWsClose(t, pkt, err, wsCloseMessageTooBig)
+
+	// 每个分片都不超，合起来超了
+	c = newWebSocketCodec(16)
+	pkt, err = c.Decode(frames(
+		clientFrame(false, wsOpBinary, bytes.Repeat([]byte{1}, 10), true),
+		clientFrame(true, wsOpContinuation, bytes.Repeat([]byte{1}, 10), true),
+	))
+	expectWsClose(t, pkt, err, wsCloseMessageTooBig)
+
+	// 正好16字节可以
+	c = newWebSocketCodec(16)
+	pkt, err = c.Decode(frames(clientFrame(true, wsOpBinary, bytes.Repeat([]byte{1}, 16), true)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt.Release()
+}
+
+func TestWebSocketCodecEncode(t *testing.T) {
+	c := newWebSocketCodec(0)
+	var b bytes.Buffer
+
+	pkt := NewProtoPacket(7)
+	pkt.WriteBytes(bytes.Repeat([]byte{'x'}, 200))
+	if err := c.Encode(&b, pkt); err != nil {
+		t.Fatal(err)
+	}
+	pkt.Release()
+	ping := NewPingPacket()
+	if err := c.Encode(&b, ping); err != nil {
+		t.Fatal(err)
+	}
+	ping.Release()
+
+	r := bufio.NewReader(&b)
+	fin, opcode, payload := readServerFrame(t, r)
+	if !fin || opcode != wsOpBinary || len(payload) != 204 {
+		t.Fatalf("binary frame fin %v opcode %d len %d", fin, opcode, len(payload))
+	}
+	if fin, opcode, payload = readServerFrame(t, r); !fin || opcode != wsOpPing || len(payload) != 0 {
+		t.Fatalf("ping frame fin %v opcode %d len %d", fin, opcode, len(payload))
+	}
+}
+
+// 读服务器发的帧，服务器的帧不能加掩码
+func readServerFrame(t *testing.T, r *bufio.Reader) (fin bool, opcode byte, payload []byte) {
+	t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if header[1]&0x80 != 0 {
+		t.Fatal("server frame masked")
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var n uint16
+		binary.Read(r, binary.BigEndian, &n)
+		length = uint64(n)
+	case 127:
+		binary.Read(r, binary.BigEndian, &length)
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0]&0x80 != 0, header[0] & 0x0F, payload
+}
+
+// 升级成WebSocket连接，返回的reader里可能已经有服务器发的帧
+func dialWebSocket(t *testing.T, url string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if err = req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("upgrade response %s", resp.Status)
+	}
+	return conn, r
+}
+
+func startWebSocketServer(t *testing.T, opt ...TcpOption) string {
+	server := NewTcpServer("", opt...)
+	r := NewRouter()
+	r.Register(1, func(s *Session, pkt *Packet) {
+		resp := NewProtoPacket(2)
+		resp.WriteString(pkt.ReadString())
+		s.SendPacket(resp)
+	})
+	server.SetSessionEventHandler(r)
+	ts := httptest.NewServer(server.WebSocketHandler())
+	t.Cleanup(func() {
+		server.Stop()
+		ts.Close()
+	})
+	return ts.URL
+}
+
+func TestWebSocketCloseEcho(t *testing.T) {
+	conn, r := dialWebSocket(t, startWebSocketServer(t))
+
+	// 收发一个消息确认连接正常，再发起关闭
+	req := NewProtoPacket(1)
+	req.WriteString("hi")
+	sent := req.readableData()
+	conn.Write(clientFrame(true, wsOpBinary, sent, true))
+	// 回复只是协议ID不同
+	if _, opcode, payload := readServerFrame(t, r); opcode != wsOpBinary || !bytes.Equal(payload[4:], sent[4:]) {
+		t.Fatalf("echo opcode %d payload %v", opcode, payload)
+	}
+	req.Release()
+
+	closePayload := []byte{0x03, 0xE8, 'b', 'y', 'e'} // 1000 bye
+	conn.Write(clientFrame(true, wsOpClose, closePayload, true))
+	fin, opcode, payload := readServerFrame(t, r)
+	if !fin || opcode != wsOpClose || !bytes.Equal(payload, closePayload) {
+		t.Fatalf("close reply fin %v opcode %d payload %v", fin, opcode, payload)
+	}
+	// 回完Close帧后服务器断开
+	if _, err := r.ReadByte(); err == nil {
+		t.Fatal("server kept the connection after close")
+	}
+}
+
+func TestWebSocketProtocolErrorClose(t *testing.T) {
+	conn, r := dialWebSocket(t, startWebSocketServer(t))
+
+	conn.Write(clientFrame(false, wsOpPing, []byte("x"), true))
+	_, opcode, payload := readServerFrame(t, r)
+	if opcode != wsOpClose || len(payload) != 2 || binary.BigEndian.Uint16(payload) != wsCloseProtocolError {
+		t.Fatalf("reply opcode %d payload %v, want close 1002", opcode, payload)
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Fatal("server kept the connection after protocol error")
+	}
+}
+
+func TestWebSocketEncryptionControlFrames(t *testing.T) {
+	conn, r := dialWebSocket(t, startWebSocketServer(t, WithEncryption()))
+
+	// 浏览器端用二进制帧做密钥交换
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := newControlPacket(pktKindHandshake, featureEncrypt)
+	hello.WriteBytes(priv.PublicKey().Bytes())
+	conn.Write(clientFrame(true, wsOpBinary, hello.readableData(), true))
+	hello.Release()
+	_, opcode, payload := readServerFrame(t, r)
+	if opcode != wsOpBinary || len(payload) < 4 || packetEndian.Uint32(payload)>>pktKindShift != pktKindHandshake {
+		t.Fatalf("handshake reply opcode %d payload %v", opcode, payload)
+	}
+	send, recv, err := deriveCiphers(priv, payload[4:], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 控制帧是明文的，服务器要能直接回pong
+	conn.Write(clientFrame(true, wsOpPing, []byte("hb"), true))
+	if _, opcode, payload = readServerFrame(t, r); opcode != wsOpPong || string(payload) != "hb" {
+		t.Fatalf("ping reply opcode %d payload %q, want pong hb", opcode, payload)
+	}
+
+	// 业务消息两个方向都加密
+	sealed := send.encrypt(plainPacket("secret"))
+	conn.Write(clientFrame(true, wsOpBinary, sealed.readableData(), true))
+	sealed.Release()
+	_, opcode, payload = readServerFrame(t, r)
+	if opcode != wsOpBinary || bytes.Contains(payload, []byte("secret")) {
+		t.Fatalf("reply opcode %d payload %q not encrypted", opcode, payload)
+	}
+	reply := NewPacket()
+	reply.WriteBytes(payload)
+	opened, err := recv.decrypt(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, got := opened.ReadUint32(), opened.ReadString(); id != 2 || got != "secret" {
+		t.Fatalf("decrypted reply %d %q, want 2 secret", id, got)
+	}
+	opened.Release()
+
+	// Close帧也不经过加密，服务器原样回复后断开
+	closePayload := []byte{0x03, 0xE8}
+	conn.Write(clientFrame(true, wsOpClose, closePayload, true))
+	if _, opcode, payload = readServerFrame(t, r); opcode != wsOpClose || !bytes.Equal(payload, closePayload) {
+		t.Fatalf("close reply opcode %d payload %v", opcode, payload)
+	}
+	if _, err = r.ReadByte(); err == nil {
+		t.Fatal("server kept the connection after close")
+	}
+}
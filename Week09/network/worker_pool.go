@@ -0,0 +1,202 @@
+package network
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// 固定数量的工作协程，同一个key的任务总是交给同一个协程，按提交顺序执行
+func NewWorkerPool(workers, queueSize int) *WorkerPool {
+	if workers <= 0 {
+		workers = 1
+	}
+	p := &WorkerPool{
+		queues: make([]chan func(), workers),
+		stopCh: make(chan struct{}),
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan func(), queueSize)
+		p.wg.Add(1)
+		go p.loopWork(p.queues[i])
+	}
+	return p
+}
+
+type WorkerPool struct {
+	queues   []chan func()
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// 提交任务，队列满时阻塞，已经停止返回false
+func (p *WorkerPool) Submit(key uint32, task func()) bool {
+	select {
+	case <-p.stopCh:
+		return false
+	default:
+	}
+	select {
+	case p.queues[key%uint32(len(p.queues))] <- task:
+		return true
+	case <-p.stopCh:
+		return false
+	}
+}
+
+// 停止接收新任务，等已经提交的任务执行完
+func (p *WorkerPool) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stopCh)
+	})
+	p.wg.Wait()
+}
+
+func (p *WorkerPool) loopWork(queue chan func()) {
+	defer p.wg.Done()
+	for {
+		select {
+		case task := <-queue:
+			p.run(task)
+		case <-p.stopCh:
+			for {
+				select {
+				case task := <-queue:
+					p.run(task)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *WorkerPool) run(task func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("worker pool task crashed", r)
+		}
+	}()
+	task()
+}
+
+// WorkerPool模式：服务协程只负责读，收到的包、定时检查和关闭都作为任务交给
+// session对应的工作协程，同一个session的事件仍然是串行的
+func (s *Session) serveWithPool(ctx context.Context) {
+	if s.handler != nil {
+		if err := s.handler.OnOpen(s); err != nil {
+			return
+		}
+	}
+
+	writeDone := make(chan struct{})
+	go func() {
+		s.loopWrite(ctx, writeDone)
+		// 写协程退出后连接也就没法用了，让读返回
+		s.conn.Close()
+	}()
+
+	s.touchRecvTime()
+	s.scheduleCron()
+
+	for {
+		pkt, err := s.readPacket()
+		if err != nil {
+			s.finishWithPool(err)
+			break
+		}
+		if pkt != nil && !s.submitPacket(pkt) {
+			return
+		}
+	}
+
+	select {
+	case <-s.closeCh:
+	case <-writeDone:
+	}
+}
+
+// 读结束后，等已经提交的包处理完再关闭
+func (s *Session) finishWithPool(err error) {
+	draining := s.isDraining()
+	ok := s.submit(func() {
+		if draining {
+			s.notifyShutdown()
+			if s.lazyWrite {
+				s.flushQueued()
+				s.Close()
+				return
+			}
+			// 写协程写完队列后退出，服务协程再关闭session
+			close(s.flushCh)
+			return
+		}
+		if isTimeoutErr(err) {
+			s.onIdle()
+		}
+		s.Close()
+	})
+	if !ok {
+		// 工作协程池已经停止，没法再按顺序处理，直接关闭，否则服务协程会一直等下去
+		s.Close()
+	}
+}
+
+// 交给session对应的工作协程执行，session关闭后的任务直接跳过
+func (s *Session) submit(task func()) bool {
+	return s.opts.WorkerPool.Submit(s.id, func() {
+		if !s.isClosed() {
+			s.runTask(task)
+		}
+	})
+}
+
+func (s *Session) submitPacket(pkt *Packet) bool {
+	ok := s.opts.WorkerPool.Submit(s.id, func() {
+		if s.isClosed() {
+			pkt.Release()
+			return
+		}
+		s.runTask(func() { s.handlePacket(pkt) })
+	})
+	if !ok {
+		pkt.Release()
+	}
+	return ok
+}
+
+// 和StartServe一样，handler崩溃时关闭session
+func (s *Session) runTask(task func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("session[%s] task crashed: %v\n", s.strId, r)
+			s.Close()
+		}
+	}()
+	task()
+}
+
+func (s *Session) isClosed() bool {
+	select {
+	case <-s.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) scheduleCron() {
+	s.opts.clock().AfterFunc(s.cronPeriod, func() {
+		s.submit(s.cronTask)
+	})
+}
+
+func (s *Session) cronTask() {
+	s.CronCounter++
+	if !s.onCron() {
+		s.Close()
+		return
+	}
+	s.scheduleCron()
+}
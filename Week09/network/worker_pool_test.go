@@ -0,0 +1,152 @@
+package network_test
+
+import (
+	"context"
+	"github.com/wnate/Go-000/tree/main/Week09/network"
+	"github.com/wnate/Go-000/tree/main/Week09/testkit"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolKeepsSessionOrder(t *testing.T) {
+	const (
+		sessions = 6
+		packets  = 300
+	)
+	// 工作协程比session少，队列也很小，多个session共用一个协程并且经常要等队列
+	pool := network.NewWorkerPool(2, 4)
+	defer pool.Stop()
+
+	var (
+		mu       sync.Mutex
+		received = make(map[*network.Session][]uint32)
+		inFlight = make(map[*network.Session]*int32)
+		overlap  int32
+		done     sync.WaitGroup
+	)
+	done.Add(sessions * packets)
+	r := network.NewRouter()
+	r.Register(1, func(s *network.Session, pkt *network.Packet) {
+		mu.Lock()
+		running := inFlight[s]
+		if running == nil {
+			running = new(int32)
+			inFlight[s] = running
+		}
+		mu.Unlock()
+		// 同一个session的包不能并发处理
+		if atomic.AddInt32(running, 1) != 1 {
+			atomic.StoreInt32(&overlap, 1)
+		}
+		seq := pkt.ReadUint32()
+		if seq%50 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		mu.Lock()
+		received[s] = append(received[s], seq)
+		mu.Unlock()
+		atomic.AddInt32(running, -1)
+		done.Done()
+	})
+
+	peers := make([]*testkit.Peer, sessions)
+	for i := range peers {
+		peers[i] = testkit.NewPeer(r, network.WithWorkerPool(pool))
+		defer peers[i].Close()
+	}
+	var send sync.WaitGroup
+	for _, p := range peers {
+		send.Add(1)
+		go func(p *testkit.Peer) {
+			defer send.Done()
+			for seq := uint32(0); seq < packets; seq++ {
+				p.SendProto(1, func(pkt *network.Packet) {
+					pkt.WriteUint32(seq)
+				})
+			}
+		}(p)
+	}
+	send.Wait()
+
+	finished := make(chan struct{})
+	go func() {
+		done.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not all packets handled")
+	}
+
+	if atomic.LoadInt32(&overlap) != 0 {
+		t.Error("packets of one session handled concurrently")
+	}
+	for _, p := range peers {
+		seqs := received[p.Session()]
+		if len(seqs) != packets {
+			t.Fatalf("session got %d packets, want %d", len(seqs), packets)
+		}
+		for i, seq := range seqs {
+			if seq != uint32(i) {
+				t.Fatalf("session got seq %d at %d", seq, i)
+			}
+		}
+	}
+}
+
+func TestWorkerPoolStoppedWhileSubmitBlocked(t *testing.T) {
+	// 一个工作协程，队列长度1：第一个包卡在处理函数里，第二个排队，第三个提交时阻塞
+	pool := network.NewWorkerPool(1, 1)
+	block := make(chan struct{})
+	started := make(chan struct{}, 1)
+	r := network.NewRouter()
+	r.Register(1, func(s *network.Session, pkt *network.Packet) {
+		started <- struct{}{}
+		<-block
+	})
+	p := testkit.NewPeer(r, network.WithWorkerPool(pool))
+	defer p.Close()
+
+	for i := 0; i < 3; i++ {
+		p.SendProto(1, nil)
+	}
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		pool.Stop()
+		close(stopped)
+	}()
+	// 提交被拒绝后session不能再保证顺序，直接关闭
+	p.ExpectClosed(t)
+
+	close(block)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("pool did not stop")
+	}
+}
+
+func TestWorkerPoolStoppedClosesSessionOnDisconnect(t *testing.T) {
+	pool := network.NewWorkerPool(1, 1)
+	opts := network.NewDefaultTcpOptions()
+	network.WithWorkerPool(pool)(opts)
+	serverConn, clientConn := net.Pipe()
+	session := network.NewSession(serverConn, opts)
+	go session.StartServe(context.Background())
+	pool.Stop()
+
+	// 读结束后的收尾任务也提交不了，session仍然要关闭，不能让服务协程一直等
+	clientConn.Close()
+	select {
+	case <-session.Done():
+	case <-time.After(time.Second):
+		session.Close()
+		t.Fatal("session not closed after disconnect with a stopped pool")
+	}
+}
@@ -0,0 +1,79 @@
+// Code generated by pktgen. DO NOT EDIT.
+// source: demo.pkt
+
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/wnate/Go-000/tree/main/Week09/network"
+)
+
+// 协议ID
+const (
+	ProtoIdEchoReq  uint32 = 1
+	ProtoIdEchoResp uint32 = 2
+)
+
+type EchoReq struct {
+	Text string
+}
+
+func (m *EchoReq) ProtoId() uint32 {
+	return ProtoIdEchoReq
+}
+
+func (m *EchoReq) Encode(pkt *network.Packet) {
+	pkt.WriteString(m.Text)
+}
+
+func (m *EchoReq) Decode(pkt *network.Packet) (err error) {
+	defer func() {
+		// 包长度不够时Packet的ReadXxx会越界
+		if r := recover(); r != nil {
+			err = fmt.Errorf("decode EchoReq failed: %v", r)
+		}
+	}()
+	return m.decode(pkt)
+}
+
+func (m *EchoReq) decode(pkt *network.Packet) (err error) {
+	m.Text = pkt.ReadString()
+	return nil
+}
+
+type EchoResp struct {
+	Text       string
+	ServerTime int64
+}
+
+func (m *EchoResp) ProtoId() uint32 {
+	return ProtoIdEchoResp
+}
+
+func (m *EchoResp) Encode(pkt *network.Packet) {
+	pkt.WriteString(m.Text)
+	pkt.WriteInt64(m.ServerTime)
+}
+
+func (m *EchoResp) Decode(pkt *network.Packet) (err error) {
+	defer func() {
+		// 包长度不够时Packet的ReadXxx会越界
+		if r := recover(); r != nil {
+			err = fmt.Errorf("decode EchoResp failed: %v", r)
+		}
+	}()
+	return m.decode(pkt)
+}
+
+func (m *EchoResp) decode(pkt *network.Packet) (err error) {
+	m.Text = pkt.ReadString()
+	m.ServerTime = pkt.ReadInt64()
+	return nil
+}
+
+// 注册所有协议消息
+func RegisterMessages(r *network.MessageRegistry) {
+	r.Register(ProtoIdEchoReq, (*EchoReq)(nil))
+	r.Register(ProtoIdEchoResp, (*EchoResp)(nil))
+}
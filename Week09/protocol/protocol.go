@@ -0,0 +1,4 @@
+// 客户端和服务器共用的协议定义，由pktgen根据demo.pkt生成
+package protocol
+
+//go:generate go run ../cmd/pktgen -in demo.pkt -out demo.pkt.go
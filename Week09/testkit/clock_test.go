@@ -0,0 +1,93 @@
+package testkit
+
+import (
+	"github.com/wnate/Go-000/tree/main/Week09/network"
+	"testing"
+	"time"
+)
+
+func TestFakeClockTicker(t *testing.T) {
+	c := NewFakeClock(time.Unix(0, 0))
+	ticker := c.NewTicker(time.Second)
+
+	c.Advance(999 * time.Millisecond)
+	select {
+	case <-ticker.C():
+		t.Fatal("tick before period")
+	default:
+	}
+
+	// 一次推进多个周期，和time.Ticker一样只保留一个tick
+	c.Advance(3 * time.Second)
+	if tick := <-ticker.C(); !tick.Equal(time.Unix(1, 0)) {
+		t.Errorf("tick = %v, want first period", tick)
+	}
+	select {
+	case <-ticker.C():
+		t.Fatal("missed ticks should be dropped")
+	default:
+	}
+
+	ticker.Stop()
+	c.Advance(time.Hour)
+	select {
+	case <-ticker.C():
+		t.Fatal("tick after Stop")
+	default:
+	}
+}
+
+func TestFakeClockHeartbeat(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	p := NewPeer(network.NewRouter(), network.WithClock(clock), network.WithHeartbeat(3*time.Second))
+	defer p.Close()
+	clock.BlockUntilTickers(1)
+
+	// 还没发过心跳，第一次定时检查就发
+	clock.Advance(time.Second)
+	p.ExpectPing(t)
+
+	clock.Advance(time.Second)
+	p.ExpectNone(t, 20*time.Millisecond)
+	clock.Advance(time.Second)
+	p.ExpectNone(t, 20*time.Millisecond)
+
+	clock.Advance(time.Second)
+	p.ExpectPing(t)
+}
+
+func TestFakeClockReadTimeout(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	idle := make(chan struct{})
+	r := network.NewRouter()
+	r.SetIdleHandler(func(s *network.Session) {
+		close(idle)
+	})
+	p := NewPeer(r, network.WithClock(clock), network.WithReadTimeout(3*time.Second))
+	clock.BlockUntilTickers(1)
+
+	// 对端的心跳也算收到包，空闲时间重新计算
+	clock.Advance(2 * time.Second)
+	p.Send(network.NewPingPacket())
+	pong := p.Expect(t)
+	if !network.IsPongPacket(pong) {
+		t.Fatal("expect pong for ping")
+	}
+	pong.Release()
+
+	clock.Advance(2 * time.Second)
+	p.ExpectNone(t, 20*time.Millisecond)
+	select {
+	case <-p.Session().Done():
+		t.Fatal("session closed although it received a ping 2s ago")
+	default:
+	}
+
+	clock.Advance(2 * time.Second)
+	p.ExpectClosed(t)
+	select {
+	case <-idle:
+	default:
+		t.Fatal("OnIdle not called before idle session closed")
+	}
+}
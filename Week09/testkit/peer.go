@@ -0,0 +1,182 @@
+package testkit
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/wnate/Go-000/tree/main/Week09/network"
+	"net"
+	"testing"
+	"time"
+)
+
+// Expect系列等待Session发包的默认超时
+const DefaultTimeout = time.Second
+
+var (
+	errPeerTimeout = errors.New("testkit: wait packet timeout")
+	errPeerClosed  = errors.New("testkit: session closed")
+)
+
+// 测试用的对端：被测handler跑在一个真实的Session上，两端用net.Pipe连接，
+// 测试通过Peer直接发原始包给Session，并检查Session发出来的包
+func NewPeer(handler network.SessionEventHandler, opt ...network.TcpOption) *Peer {
+	opts := newOptions(opt)
+	server, client := net.Pipe()
+
+	session := network.NewSession(server, opts)
+	session.SetEventHandler(handler)
+
+	p := &Peer{
+		session: session,
+		conn:    network.NewPacketConn(client, opts.Codec),
+		recv:    make(chan *network.Packet, 100),
+		Timeout: DefaultTimeout,
+	}
+	go session.StartServe(context.Background())
+	go p.loopRecv()
+	return p
+}
+
+type Peer struct {
+	session *network.Session
+	conn    *network.PacketConn
+	recv    chan *network.Packet
+	Timeout time.Duration // Expect等待的超时
+}
+
+// 被测的Session
+func (p *Peer) Session() *network.Session {
+	return p.session
+}
+
+// 发一个包给Session，包会被回收
+func (p *Peer) Send(pkt *network.Packet) error {
+	return p.conn.SendPacket(pkt)
+}
+
+// 发一个只有协议ID的包，body不为空时用它写入消息体
+func (p *Peer) SendProto(protoId uint32, body func(pkt *network.Packet)) error {
+	pkt := network.NewProtoPacket(protoId)
+	if body != nil {
+		body(pkt)
+	}
+	return p.Send(pkt)
+}
+
+// 等待Session发出的下一个包，用完需要Release
+func (p *Peer) Recv(timeout time.Duration) (*network.Packet, error) {
+	select {
+	case pkt, ok := <-p.recv:
+		if !ok {
+			return nil, errPeerClosed
+		}
+		return pkt, nil
+	case <-time.After(timeout):
+		return nil, errPeerTimeout
+	}
+}
+
+// 等待Session发出的下一个包，超时或者连接关闭时测试失败
+func (p *Peer) Expect(t testing.TB) *network.Packet {
+	t.Helper()
+	pkt, err := p.Recv(p.Timeout)
+	if err != nil {
+		t.Fatalf("expect packet: %v", err)
+	}
+	return pkt
+}
+
+// 等待下一个包并检查协议ID，返回的包读索引指向消息体
+func (p *Peer) ExpectProto(t testing.TB, protoId uint32) *network.Packet {
+	t.Helper()
+	pkt := p.Expect(t)
+	if network.IsPingPacket(pkt) || network.IsPongPacket(pkt) {
+		pkt.Release()
+		t.Fatalf("expect proto id %d, got heartbeat packet", protoId)
+	}
+	if got := pkt.ReadUint32(); got != protoId {
+		pkt.Release()
+		t.Fatalf("expect proto id %d, got %d", protoId, got)
+	}
+	return pkt
+}
+
+// 等待一个心跳包
+func (p *Peer) ExpectPing(t testing.TB) {
+	t.Helper()
+	pkt := p.Expect(t)
+	defer pkt.Release()
+	if !network.IsPingPacket(pkt) {
+		t.Fatalf("expect ping packet, got %d bytes", pkt.ReadableBytes())
+	}
+}
+
+// d时间内Session没有再发包
+func (p *Peer) ExpectNone(t testing.TB, d time.Duration) {
+	t.Helper()
+	pkt, err := p.Recv(d)
+	if err == nil {
+		n := pkt.ReadableBytes()
+		pkt.Release()
+		t.Fatalf("expect no packet, got %d bytes", n)
+	}
+}
+
+// 等待Session关闭，例如空闲超时或者handler主动关闭
+func (p *Peer) ExpectClosed(t testing.TB) {
+	t.Helper()
+	select {
+	case <-p.session.Done():
+	case <-time.After(p.Timeout):
+		t.Fatalf("expect session closed")
+	}
+}
+
+// 断开对端，等待Session关闭，回收还没取走的包
+func (p *Peer) Close() {
+	p.conn.Close()
+	select {
+	case <-p.session.Done():
+	case <-time.After(p.Timeout):
+		p.session.Close()
+	}
+	for pkt := range p.recv {
+		pkt.Release()
+	}
+}
+
+func (p *Peer) loopRecv() {
+	defer close(p.recv)
+	for {
+		pkt, err := p.conn.ReadPacket()
+		if err != nil {
+			return
+		}
+		p.recv <- pkt
+	}
+}
+
+// 用net.Pipe连接的两个Session，都已经开始服务
+func NewSessionPair(a, b network.SessionEventHandler, opt ...network.TcpOption) (*network.Session, *network.Session) {
+	opts := newOptions(opt)
+	connA, connB := net.Pipe()
+
+	sessionA := network.NewSession(connA, opts)
+	sessionA.SetEventHandler(a)
+	sessionB := network.NewSession(connB, opts)
+	sessionB.SetEventHandler(b)
+
+	go sessionA.StartServe(context.Background())
+	go sessionB.StartServe(context.Background())
+	return sessionA, sessionB
+}
+
+func newOptions(opt []network.TcpOption) *network.TcpOptions {
+	opts := network.NewDefaultTcpOptions()
+	for _, o := range opt {
+		if o != nil {
+			o(opts)
+		}
+	}
+	return opts
+}
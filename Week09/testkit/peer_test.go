@@ -0,0 +1,84 @@
+package testkit
+
+import (
+	"github.com/wnate/Go-000/tree/main/Week09/network"
+	"testing"
+	"time"
+)
+
+func TestPeerRouter(t *testing.T) {
+	r := network.NewRouter()
+	r.Register(1, func(s *network.Session, pkt *network.Packet) {
+		resp := network.NewProtoPacket(2)
+		resp.WriteString(pkt.ReadString())
+		s.SendPacket(resp)
+	})
+	r.Register(3, func(s *network.Session, pkt *network.Packet) {
+		s.Close()
+	})
+	p := NewPeer(r)
+	defer p.Close()
+
+	p.SendProto(1, func(pkt *network.Packet) {
+		pkt.WriteString("hello")
+	})
+	resp := p.ExpectProto(t, 2)
+	if got := resp.ReadString(); got != "hello" {
+		t.Errorf("echo = %q, want hello", got)
+	}
+	resp.Release()
+
+	// 没注册的协议号不回复，也不影响后面的包
+	p.SendProto(100, nil)
+	p.ExpectNone(t, 20*time.Millisecond)
+
+	p.SendProto(3, nil)
+	p.ExpectClosed(t)
+	if _, err := p.Recv(p.Timeout); err != errPeerClosed {
+		t.Fatalf("recv after session closed = %v, want %v", err, errPeerClosed)
+	}
+}
+
+func TestPeerCloseClosesSession(t *testing.T) {
+	closed := make(chan struct{})
+	r := network.NewRouter()
+	r.SetCloseHandler(func(s *network.Session) {
+		close(closed)
+	})
+	p := NewPeer(r)
+	p.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("OnClose not called after peer closed")
+	}
+}
+
+func TestSessionPair(t *testing.T) {
+	got := make(chan string, 1)
+	b := network.NewRouter()
+	b.Register(1, func(s *network.Session, pkt *network.Packet) {
+		got <- pkt.ReadString()
+	})
+	sessionA, sessionB := NewSessionPair(network.NewRouter(), b)
+	defer sessionB.Close()
+
+	pkt := network.NewProtoPacket(1)
+	pkt.WriteString("from a")
+	sessionA.SendPacket(pkt)
+	select {
+	case s := <-got:
+		if s != "from a" {
+			t.Errorf("b got %q", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("b did not receive packet")
+	}
+
+	sessionA.Close()
+	select {
+	case <-sessionB.Done():
+	case <-time.After(time.Second):
+		t.Fatal("b not closed after a closed")
+	}
+}